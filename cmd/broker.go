@@ -0,0 +1,50 @@
+package main
+
+import (
+	"contact-monitoring-ingest-api/internal/positionevent"
+	"log"
+	"os"
+	"strings"
+)
+
+var brokerType = os.Getenv("BROKER")
+var kafkaBrokers = os.Getenv("KAFKA_BROKERS")
+var kafkaEventTopic = os.Getenv("KAFKA_EVENT_TOPIC")
+var kafkaMinuteAggregateTopic = os.Getenv("KAFKA_MINUTE_AGGREGATE_TOPIC")
+var kafkaGroupID = os.Getenv("KAFKA_GROUP_ID")
+
+// newBroker returns the broker selected by the BROKER env, buffering
+// eventBuffer events and partitionSize minute aggregates in each of
+// partitions partitions in this process. Only the topics consumed by
+// the workers r runs are consumed.
+func newBroker(eventBuffer int, partitions int, r roles) positionevent.Broker {
+	switch brokerType {
+	case "", "channel":
+		return positionevent.NewChannelBroker(eventBuffer, partitions, partitionSize)
+	case "kafka":
+		if kafkaBrokers == "" {
+			log.Fatal("You must provide a KAFKA_BROKERS env when BROKER is kafka")
+		}
+		return positionevent.NewKafkaBroker(positionevent.KafkaBrokerConfig{
+			Brokers:                 strings.Split(kafkaBrokers, ","),
+			EventTopic:              envOr(kafkaEventTopic, "position-events"),
+			MinuteAggregateTopic:    envOr(kafkaMinuteAggregateTopic, "minute-aggregates"),
+			GroupID:                 envOr(kafkaGroupID, "contact-monitoring-ingest"),
+			ConsumeEvents:           r.eventWorkers,
+			ConsumeMinuteAggregates: r.aggregateWorkers,
+			EventBuffer:             eventBuffer,
+			Partitions:              partitions,
+			PartitionBuffer:         partitionSize,
+		})
+	}
+
+	log.Fatalf("BROKER must be channel or kafka, got %q", brokerType)
+	return nil
+}
+
+func envOr(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -4,10 +4,13 @@ import (
 	"contact-monitoring-ingest-api/internal/auth"
 	"contact-monitoring-ingest-api/internal/device"
 	"contact-monitoring-ingest-api/internal/health"
+	"contact-monitoring-ingest-api/internal/indexes"
 	"contact-monitoring-ingest-api/internal/invitecode"
 	"contact-monitoring-ingest-api/internal/positionevent"
+	"contact-monitoring-ingest-api/internal/retention"
+	"contact-monitoring-ingest-api/internal/venue"
 	"context"
-	"hash/maphash"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -19,10 +22,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/joho/godotenv/autoload" // load environment vars from .env
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var port = os.Getenv("PORT")
@@ -33,168 +33,376 @@ var inviteCodeUser = os.Getenv("INVITE_CODE_USER")
 var inviteCodePass = os.Getenv("INVITE_CODE_PASS")
 var maxDistanceBetweenDevices = os.Getenv("MAXIMUM_DISTANCE_BETWEEN_DEVICES")
 var accThreshold = os.Getenv("ACCURACY_THRESHOLD")
+var minimumContactDuration = os.Getenv("MIN_CONTACT_DURATION")
+var distanceRuleName = os.Getenv("DISTANCE_RULE")
+var contactGapTolerance = os.Getenv("CONTACT_GAP_TOLERANCE")
+var timeBucketSize = os.Getenv("TIME_BUCKET_SIZE")
+var queueWaitTimeout = os.Getenv("QUEUE_WAIT_TIMEOUT")
+var maxClockSkew = os.Getenv("MAX_CLOCK_SKEW")
+var allowedLateness = os.Getenv("ALLOWED_LATENESS")
+var interpolationMaxGap = os.Getenv("INTERPOLATION_MAX_GAP")
+var selectionStrategyName = os.Getenv("SELECTION_STRATEGY")
+var indexMode = os.Getenv("INDEX_MODE")
+var retentionDays = os.Getenv("RETENTION_DAYS")
+var venueRetentionDays = os.Getenv("VENUE_RETENTION_DAYS")
+var retentionInterval = os.Getenv("RETENTION_INTERVAL")
+var eventWorkerCount = os.Getenv("EVENT_WORKERS")
+var aggregateWorkerCount = os.Getenv("AGGREGATE_WORKERS")
+var mongoMaxPoolSize = os.Getenv("MONGO_MAX_POOL_SIZE")
+
+// how often and after how long pending work that was put aside
+// because a queue was full is handed to the workers again
+const redeliveryInterval = time.Minute
+const redeliveryAge = 5 * time.Minute
+
+// how long the event worker that replays and redelivers pending work
+// holds on to it without renewing it, after which another takes over
+const replayLeaseTTL = 3 * redeliveryInterval
+
+// how many RETENTION_INTERVALs the event worker that purges holds on to
+// the retention lease without renewing it, after which another takes over
+const retentionLeaseFactor = 2
+
+// how long after it could last have been extended by on time data a
+// contact event is closed, which leaves room for redelivered work
+const contactCloseDelay = 2 * redeliveryAge
+
+const partitionSize = 10
+
+// how long venue configuration is cached before it is read again
+const venueConfigTTL = 30 * time.Second
+
+// readiness fails when a dependency takes longer than readinessTimeout
+// to respond or any queue is at least maxQueueSaturation full
+const readinessTimeout = 2 * time.Second
+const maxQueueSaturation = 0.9
+
+// roles are the parts of the service a process runs
+type roles struct {
+	// api serves the device and admin routes
+	api bool
+	// eventWorkers consume position events and, since they are the
+	// ones producing work, replay and redeliver pending work and
+	// purge expired data as well
+	eventWorkers bool
+	// aggregateWorkers consume minute aggregates
+	aggregateWorkers bool
+}
 
-func main() {
-	log.Printf("PID: %d GOMAXPROCS is %d\n", os.Getpid(), runtime.GOMAXPROCS(0))
+func (r roles) all() bool {
+	return r.api && r.eventWorkers && r.aggregateWorkers
+}
 
-	var mongoDBMaxPoolSize uint64 = 100
-	totalWorkers := 100 // total workers should be close to mongoDBMaxPoolSize
+func main() {
+	command := "all"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
 
-	if port == "" {
-		log.Fatal("You must provide a PORT env")
+	switch command {
+	case "migrate":
+		migrate(os.Args[2:])
+	case "reprocess":
+		reprocess(os.Args[2:])
+	case "serve":
+		run(command, roles{api: true})
+	case "event-worker":
+		run(command, roles{eventWorkers: true})
+	case "aggregate-worker":
+		run(command, roles{aggregateWorkers: true})
+	case "all":
+		run(command, roles{api: true, eventWorkers: true, aggregateWorkers: true})
+	default:
+		log.Fatalf("unknown command %q, expected serve, event-worker, aggregate-worker, all, migrate or reprocess", command)
 	}
+}
 
-	if mongoURL == "" {
-		log.Fatal("You must provide a MONGO_URL env")
+// run runs the parts of the service selected by r. Every process serves
+// the health and metrics routes so it can be probed and scraped.
+func run(command string, r roles) {
+	log.Printf("PID: %d GOMAXPROCS is %d running %s\n", os.Getpid(), runtime.GOMAXPROCS(0), command)
+	startedAt := time.Now()
+
+	// a process running only some roles hands its work to the others
+	// through the broker, which has to be shared between processes
+	if !r.all() && brokerType != "kafka" {
+		log.Fatalf("The %s command needs BROKER to be kafka", command)
 	}
 
-	if mongoDBName == "" {
-		log.Fatal("You must provide a MONGO_DB_NAME env")
+	eventWorkers := intEnv("EVENT_WORKERS", eventWorkerCount, 100)
+	aggregateWorkers := intEnv("AGGREGATE_WORKERS", aggregateWorkerCount, 100)
+	// the workers hold a connection each while processing, so
+	// the pool should be close to the workers of this process
+	maxPoolSize := uint64(intEnv("MONGO_MAX_POOL_SIZE", mongoMaxPoolSize, 100))
+
+	if port == "" {
+		log.Fatal("You must provide a PORT env")
 	}
 
-	if deviceTokenSecret == "" {
+	if r.api && deviceTokenSecret == "" {
 		log.Fatal("You must provide a DEVICE_TOKEN_SECRET env")
 	}
 
-	if inviteCodeUser == "" {
+	if r.api && inviteCodeUser == "" {
 		log.Fatal("You must provide a INVITE_CODE_USER env")
 	}
 
-	if inviteCodePass == "" {
+	if r.api && inviteCodePass == "" {
 		log.Fatal("You must provide a INVITE_CODE_PASS env")
 	}
 
-	var maximumDistanceBetweenDevices float64 = 0
-	if maxDistanceBetweenDevices != "" {
+	defaults, distanceRule, maxContactGap := processingConfig()
+
+	queueTimeout := time.Second
+	if queueWaitTimeout != "" {
 		var err error
-		maximumDistanceBetweenDevices, err = strconv.ParseFloat(maxDistanceBetweenDevices, 64)
+		queueTimeout, err = time.ParseDuration(queueWaitTimeout)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	var accuracyThreshold float64 = 0
-	if accThreshold != "" {
+	clockSkew := time.Minute
+	if maxClockSkew != "" {
 		var err error
-		accuracyThreshold, err = strconv.ParseFloat(accThreshold, 64)
+		clockSkew, err = time.ParseDuration(maxClockSkew)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	var lateness time.Duration
+	if allowedLateness != "" {
+		var err error
+		lateness, err = time.ParseDuration(allowedLateness)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// MONGO
-	// we want the write concern to be "write majority" so that after
-	// inserting a new position event we can be confident that
-	// processing done afterwards will include it in subsequent queries.
-	// If we don't have this write concern we can have cases where
-	// concurrent inserts for positions near each other don't generate
-	// a minute aggregate because both are missed in their nearby query
-	log.Println("Connecting to mongo")
-	dbOptions := options.Client().
-		ApplyURI(mongoURL).
-		SetMaxPoolSize(mongoDBMaxPoolSize).
-		SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
-
-	dbClient, err := mongo.Connect(ctx, dbOptions)
+	var interpolationGap time.Duration
+	if interpolationMaxGap != "" {
+		var err error
+		interpolationGap, err = time.ParseDuration(interpolationMaxGap)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	selection, err := positionevent.ParseSelectionStrategy(selectionStrategyName)
 	if err != nil {
-		log.Fatal("Cannot connect to mongodb", err)
+		log.Fatal(err)
 	}
-	defer dbClient.Disconnect(ctx)
 
-	// Call Ping to verify that the deployment is up and the Client was configured successfully.
-	// As mentioned in the Ping documentation, this reduces application resiliency as the server may be
-	// temporarily unavailable when Ping is called.
-	go func() {
-		if err = dbClient.Ping(ctx, readpref.Primary()); err != nil {
+	retentionPolicy, err := retention.ParsePolicy(retentionDays, venueRetentionDays)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	purgeInterval := time.Hour
+	if retentionInterval != "" {
+		purgeInterval, err = time.ParseDuration(retentionInterval)
+		if err != nil {
 			log.Fatal(err)
-		} else {
-			log.Println("Connected to mongo successfully")
 		}
-	}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	dbClient := connectMongo(ctx, maxPoolSize)
+	defer dbClient.Disconnect(ctx)
 
 	db := dbClient.Database(mongoDBName)
-	eventCollection := db.Collection("position-event")
+	provisionIndexes(ctx, db, indexMode)
 
-	eventChan := make(chan positionevent.PositionEvent, totalWorkers)
-	minAggregateChan := make(chan positionevent.MinuteAggregate, totalWorkers)
+	eventStore := positionevent.NewMongoStore(db)
 
-	gin.DefaultWriter = os.Stdout
+	// the env vars are the defaults for venues without their own configuration
+	venueRepo := venue.NewRepo(db.Collection("venue-config"))
+	venues := venue.NewCache(venueRepo, defaults, venueConfigTTL)
 
-	codeRepo := invitecode.NewRepo(db.Collection("invite-code"))
-	deviceRepo := device.NewRepo(db.Collection("device"))
+	broker := newBroker(eventWorkers, aggregateWorkers, r)
+
+	gin.DefaultWriter = os.Stdout
 
 	router := gin.New()
 	router.Use(gin.Recovery())
 	router.Use(gin.Logger())
 	router.GET("/health", health.GetHandler())
+	router.GET("/health/live", health.GetHandler())
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	router.POST(
-		"/positions",
-		auth.DeviceTokenMiddleware(deviceTokenSecret),
-		positionevent.PostHandler(eventCollection, eventChan, accuracyThreshold),
-	)
+	if r.api {
+		codeRepo := invitecode.NewRepo(db.Collection("invite-code"))
+		deviceRepo := device.NewRepo(db.Collection("device"))
 
-	inviteCodeRoutes := router.Group(
-		"/invite-code",
-		gin.BasicAuth(gin.Accounts{
+		// the invite code credentials double as the credentials for
+		// the routes that read back processed contact data
+		adminAccounts := gin.Accounts{
 			inviteCodeUser: inviteCodePass,
-		}),
-	)
-	{
-		inviteCodeRoutes.POST(":venue", invitecode.CreateHandler(codeRepo))
-	}
+		}
+
+		router.POST(
+			"/positions",
+			auth.DeviceTokenMiddleware(deviceTokenSecret),
+			positionevent.PostHandler(positionevent.PostHandlerConfig{
+				Store:               eventStore,
+				Broker:              broker,
+				Venues:              venues,
+				Devices:             deviceRepo,
+				QueueTimeout:        queueTimeout,
+				MaxClockSkew:        clockSkew,
+				AllowedLateness:     lateness,
+				Selection:           selection,
+				InterpolationMaxGap: interpolationGap,
+			}),
+		)
+
+		inviteCodeRoutes := router.Group(
+			"/invite-code",
+			gin.BasicAuth(adminAccounts),
+		)
+		{
+			inviteCodeRoutes.POST(":venue", invitecode.CreateHandler(codeRepo))
+		}
+
+		contactRoutes := router.Group(
+			"/contacts",
+			gin.BasicAuth(adminAccounts),
+		)
+		{
+			contactRoutes.GET("", positionevent.GetContactsHandler(eventStore, venues))
+			contactRoutes.GET("graph", positionevent.GetContactGraphHandler(eventStore, venues))
+			contactRoutes.GET("daily", positionevent.GetDailyExposuresHandler(eventStore))
+			contactRoutes.GET("changes", positionevent.GetContactChangesHandler(eventStore))
+		}
+
+		venueRoutes := router.Group(
+			"/venues",
+			gin.BasicAuth(adminAccounts),
+		)
+		{
+			venueRoutes.GET("", venue.ListHandler(venueRepo))
+			venueRoutes.GET(":venue", venue.GetHandler(venues))
+			venueRoutes.PUT(":venue", venue.PutHandler(venueRepo, venues))
+			venueRoutes.DELETE(":venue", venue.DeleteHandler(venueRepo, venues))
+			venueRoutes.GET(":venue/occupancy", positionevent.GetOccupancyHandler(eventStore, venues))
+		}
 
-	deviceRoutes := router.Group("/device")
-	{
-		deviceByIDRoutes := deviceRoutes.Group(":id")
+		deviceRoutes := router.Group("/device")
 		{
-			deviceByIDRoutes.POST("activate", device.ActivateHandler(codeRepo, deviceRepo))
-			deviceByIDRoutes.GET("token", auth.GetDeviceTokenHandler(deviceTokenSecret, deviceRepo))
+			deviceByIDRoutes := deviceRoutes.Group(":id")
+			{
+				deviceByIDRoutes.POST("activate", device.ActivateHandler(codeRepo, deviceRepo))
+				deviceByIDRoutes.GET("token", auth.GetDeviceTokenHandler(deviceTokenSecret, deviceRepo))
+			}
 		}
 	}
 
-	var wg sync.WaitGroup
-	for i := 1; i <= totalWorkers; i++ {
-		wg.Add(1)
-		go positionevent.EventWorker(positionevent.EventWorkerConfig{
-			DB:                            db,
-			EventChan:                     eventChan,
-			MinAggregateChan:              minAggregateChan,
-			WG:                            &wg,
-			MaximumDistanceBetweenDevices: maximumDistanceBetweenDevices,
-			AccuracyThreshold:             accuracyThreshold,
-			Name:                          i,
-		})
+	// readiness only covers the queues this process consumes
+	var queues []health.Queue
+	workers := map[string]int{}
+
+	var eventWG sync.WaitGroup
+	if r.eventWorkers {
+		for i := 1; i <= eventWorkers; i++ {
+			eventWG.Add(1)
+			go positionevent.EventWorker(positionevent.EventWorkerConfig{
+				Store:          eventStore,
+				Broker:         broker,
+				PublishTimeout: queueTimeout,
+				WG:             &eventWG,
+				Venues:         venues,
+				Rule:           distanceRule,
+				Name:           i,
+			})
+		}
+
+		events := broker.Events()
+		positionevent.RegisterQueueDepth("event", func() int { return len(events) })
+		queues = append(queues, health.Queue{Name: "event", Len: func() int { return len(events) }, Cap: cap(events)})
+		workers["event"] = eventWorkers
 	}
 
-	partitions := make(map[int](chan positionevent.MinuteAggregate))
-	for i := 0; i < totalWorkers; i++ {
-		partitions[i] = make(chan positionevent.MinuteAggregate, 10)
-		// along with the one goroutine that triages each event, each worker goroutine
-		// represents a consumer on the minAggregateChan
-		wg.Add(1)
-		go positionevent.AggregateWorker(db, partitions[i], &wg, i)
+	// the broker partitions minute aggregates by their pair of devices so the
+	// minute aggregates of a pair are merged by one worker in order. Merges are
+	// transactional so this isn't needed for correctness, but it avoids
+	// concurrent merges of the same pair conflicting and retrying.
+	var aggregateWG sync.WaitGroup
+	if r.aggregateWorkers {
+		for i := 0; i < broker.Partitions(); i++ {
+			aggregateWG.Add(1)
+			go positionevent.AggregateWorker(positionevent.AggregateWorkerConfig{
+				Store:            eventStore,
+				MinAggregateChan: broker.MinuteAggregates(i),
+				WG:               &aggregateWG,
+				MaxGap:           maxContactGap,
+				CloseDelay:       contactCloseDelay,
+				Name:             i,
+			})
+		}
+
+		for i := 0; i < broker.Partitions(); i++ {
+			partition := broker.MinuteAggregates(i)
+			positionevent.RegisterQueueDepth(fmt.Sprintf("partition_%d", i), func() int { return len(partition) })
+		}
+		queues = append(queues, health.Queue{Name: "fullest_partition", Len: func() int {
+			fullest := 0
+			for i := 0; i < broker.Partitions(); i++ {
+				if depth := len(broker.MinuteAggregates(i)); depth > fullest {
+					fullest = depth
+				}
+			}
+			return fullest
+		}, Cap: partitionSize})
+		workers["aggregate"] = broker.Partitions()
 	}
 
-	go func() {
-		var h maphash.Hash
-
-		for minAggregate := range minAggregateChan {
-			// using maphash to imitate partitioning of data on the person id pairs
-			// this partitioning is required so we don't run into concurrency issues
-			// (eg. concurrent upserts to the same records results in current inserts;
-			// concurrent contact event writes for the same person id pair happen sequentially)
-			h.Reset()
-			h.WriteString(minAggregate.Events[0].DeviceID)
-			h.WriteString(minAggregate.Events[1].DeviceID)
-			partition := h.Sum64() % uint64(totalWorkers)
-			// one problem is this will be blocking if the partition fills up
-			partitions[int(partition)] <- minAggregate
+	router.GET("/health/ready", health.ReadyHandler(readinessTimeout, map[string]health.Check{
+		"mongo":   health.MongoCheck(dbClient),
+		"indexes": health.IndexCheck(db, indexes.Required),
+		"queues":  health.QueueCheck(queues, workers, maxQueueSaturation),
+	}))
+
+	stopRedelivery := make(chan struct{})
+	var redeliveryWG sync.WaitGroup
+	stopRetention := make(chan struct{})
+	var retentionWG sync.WaitGroup
+	if r.eventWorkers {
+		// only the event worker holding the replay lease replays and
+		// redelivers, otherwise every replica would publish each pending
+		// item again
+		hostname, _ := os.Hostname()
+		holder := fmt.Sprintf("%s/%d", hostname, os.Getpid())
+		leased, err := eventStore.AcquireLease(positionevent.ReplayLease, holder, replayLeaseTTL)
+		if err != nil {
+			log.Fatal("Cannot acquire the replay lease", err)
+		}
+		if leased {
+			// requeue anything a previous process stored but never finished processing
+			// before accepting new events so it is not starved by live traffic
+			replayedAggregates, replayedEvents, err := positionevent.Replay(eventStore, startedAt, broker)
+			if err != nil {
+				log.Fatal("Cannot replay pending events", err)
+			}
+			log.Printf("Replayed %d pending minute aggregates and %d pending position events\n", replayedAggregates, replayedEvents)
+		} else {
+			log.Println("Another event worker holds the replay lease, leaving pending work to it")
 		}
-	}()
+
+		redeliveryWG.Add(1)
+		go positionevent.Redeliver(eventStore, holder, redeliveryInterval, replayLeaseTTL, redeliveryAge, broker, stopRedelivery, &redeliveryWG)
+
+		// likewise only the event worker holding the retention lease purges
+		retentionWG.Add(1)
+		go retention.Worker(&retention.Purger{
+			DB:          db,
+			Policy:      retentionPolicy,
+			BucketSize:  positionevent.TimeBucketSize,
+			BucketSizes: venue.TimeBucketSizes,
+		}, eventStore, holder, purgeInterval, retentionLeaseFactor*purgeInterval, stopRetention, &retentionWG)
+	}
 
 	// declare server
 	server := &http.Server{
@@ -230,13 +438,99 @@ func main() {
 		os.Exit(1)
 	}
 
-	close(eventChan)
-	close(minAggregateChan)
-	for _, partitionChannel := range partitions {
-		close(partitionChannel)
+	close(stopRedelivery)
+	redeliveryWG.Wait()
+	close(stopRetention)
+	retentionWG.Wait()
+
+	// the event workers publish minute aggregates until they have
+	// drained their events, so stop them before the aggregate workers
+	broker.CloseEvents()
+	eventWG.Wait()
+	broker.CloseMinuteAggregates()
+	aggregateWG.Wait()
+	if err := broker.Close(); err != nil {
+		log.Println("error closing broker", err)
 	}
 
-	wg.Wait()
 	log.Println("Server shutdown finished")
 	os.Exit(0)
 }
+
+// intEnv parses value, the value of the name env, as a positive
+// integer or returns fallback when it is empty
+func intEnv(name string, value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Fatalf("%s must be a positive integer, got %q", name, value)
+	}
+	return n
+}
+
+// processingConfig parses the envs configuring how position events are
+// processed: the venue configuration of venues without their own, the
+// distance rule and the gap tolerance of contact events
+func processingConfig() (defaults venue.Config, distanceRule positionevent.DistanceRule, maxContactGap time.Duration) {
+	var maximumDistanceBetweenDevices float64 = 0
+	if maxDistanceBetweenDevices != "" {
+		var err error
+		maximumDistanceBetweenDevices, err = strconv.ParseFloat(maxDistanceBetweenDevices, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var accuracyThreshold float64 = 0
+	if accThreshold != "" {
+		var err error
+		accuracyThreshold, err = strconv.ParseFloat(accThreshold, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	minContactDuration := 0
+	if minimumContactDuration != "" {
+		var err error
+		minContactDuration, err = strconv.Atoi(minimumContactDuration)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	distanceRule, err := positionevent.ParseDistanceRule(distanceRuleName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if contactGapTolerance != "" {
+		gap, err := strconv.ParseUint(contactGapTolerance, 10, 32)
+		if err != nil {
+			log.Fatal(err)
+		}
+		maxContactGap = time.Duration(gap) * time.Minute
+	}
+
+	bucketSize := positionevent.TimeBucketSize
+	if timeBucketSize != "" {
+		var err error
+		bucketSize, err = strconv.ParseInt(timeBucketSize, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !venue.ValidTimeBucketSize(bucketSize) {
+			log.Fatal("TIME_BUCKET_SIZE must be one of 15000, 30000, 60000 or 300000")
+		}
+	}
+
+	defaults = venue.Config{
+		AccuracyThreshold:  accuracyThreshold,
+		ContactDistance:    maximumDistanceBetweenDevices,
+		MinContactDuration: minContactDuration,
+		TimeBucketSize:     bucketSize,
+	}
+	return
+}
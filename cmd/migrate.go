@@ -0,0 +1,86 @@
+package main
+
+import (
+	"contact-monitoring-ingest-api/internal/indexes"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// index modes for INDEX_MODE
+const (
+	indexModeEnsure = "ensure"
+	indexModeVerify = "verify"
+	indexModeOff    = "off"
+)
+
+// migrate creates the indexes the service relies on, or with -verify only
+// checks that they exist, then exits non zero if anything is wrong
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "only check that the required indexes exist and match")
+	flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	dbClient := connectMongo(ctx, 1)
+	defer dbClient.Disconnect(ctx)
+	db := dbClient.Database(mongoDBName)
+
+	mode := indexModeEnsure
+	if *verify {
+		mode = indexModeVerify
+	}
+	if !checkIndexes(ctx, db, mode) {
+		dbClient.Disconnect(ctx)
+		os.Exit(1)
+	}
+}
+
+// provisionIndexes applies INDEX_MODE at startup, exiting if the required
+// indexes can't be created or, in verify mode, are missing or differ
+func provisionIndexes(ctx context.Context, db *mongo.Database, mode string) {
+	if mode == "" {
+		mode = indexModeEnsure
+	}
+	if mode == indexModeOff {
+		return
+	}
+	if !checkIndexes(ctx, db, mode) {
+		log.Fatal("Required indexes are not in place; run the migrate command or set INDEX_MODE=ensure")
+	}
+}
+
+func checkIndexes(ctx context.Context, db *mongo.Database, mode string) bool {
+	switch mode {
+	case indexModeEnsure:
+		log.Printf("Ensuring %d indexes exist\n", len(indexes.Required))
+		if err := indexes.Ensure(ctx, db, indexes.Required); err != nil {
+			log.Println(err)
+			return false
+		}
+		log.Println("Indexes are in place")
+		return true
+	case indexModeVerify:
+		problems, err := indexes.Verify(ctx, db, indexes.Required)
+		if err != nil {
+			log.Println("Cannot verify indexes", err)
+			return false
+		}
+		for _, problem := range problems {
+			log.Println("Index", problem)
+		}
+		if len(problems) == 0 {
+			log.Println("Indexes are in place")
+		}
+		return len(problems) == 0
+	default:
+		log.Printf("Unknown index mode %q; use %s, %s or %s\n", mode, indexModeEnsure, indexModeVerify, indexModeOff)
+		return false
+	}
+}
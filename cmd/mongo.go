@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// connectMongo connects to MONGO_URL or exits
+func connectMongo(ctx context.Context, maxPoolSize uint64) *mongo.Client {
+	if mongoURL == "" {
+		log.Fatal("You must provide a MONGO_URL env")
+	}
+
+	if mongoDBName == "" {
+		log.Fatal("You must provide a MONGO_DB_NAME env")
+	}
+
+	// MONGO
+	// we want the write concern to be "write majority" so that after
+	// inserting a new position event we can be confident that
+	// processing done afterwards will include it in subsequent queries.
+	// If we don't have this write concern we can have cases where
+	// concurrent inserts for positions near each other don't generate
+	// a minute aggregate because both are missed in their nearby query
+	log.Println("Connecting to mongo")
+	dbOptions := options.Client().
+		ApplyURI(mongoURL).
+		SetMaxPoolSize(maxPoolSize).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
+
+	dbClient, err := mongo.Connect(ctx, dbOptions)
+	if err != nil {
+		log.Fatal("Cannot connect to mongodb", err)
+	}
+
+	// Call Ping to verify that the deployment is up and the Client was configured successfully.
+	// As mentioned in the Ping documentation, this reduces application resiliency as the server may be
+	// temporarily unavailable when Ping is called.
+	go func() {
+		if err = dbClient.Ping(ctx, readpref.Primary()); err != nil {
+			log.Fatal(err)
+		} else {
+			log.Println("Connected to mongo successfully")
+		}
+	}()
+
+	return dbClient
+}
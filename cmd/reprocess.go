@@ -0,0 +1,105 @@
+package main
+
+import (
+	"contact-monitoring-ingest-api/internal/positionevent"
+	"contact-monitoring-ingest-api/internal/venue"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+// how often reprocess logs its progress
+const reprocessProgressInterval = 10 * time.Second
+
+// reprocess recomputes the minute aggregates and contact events of a venue
+// over a time range with the current venue configuration and distance rule,
+// or with -dry-run only reports what it would reprocess
+func reprocess(args []string) {
+	flags := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	venueName := flags.String("venue", "", "venue to reprocess (required)")
+	from := flags.String("from", "", "start of the time range, RFC 3339 eg. 2020-06-01T00:00:00Z (required)")
+	to := flags.String("to", "", "end of the time range, RFC 3339 (defaults to now)")
+	dryRun := flags.Bool("dry-run", false, "only report what would be reprocessed")
+	flags.Parse(args)
+
+	if *venueName == "" || *from == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fromTime, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatal("Invalid -from ", err)
+	}
+	toTime := time.Now()
+	if *to != "" {
+		toTime, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatal("Invalid -to ", err)
+		}
+	}
+	if toTime.Before(fromTime) {
+		log.Fatal("-to must not be before -from")
+	}
+
+	defaults, distanceRule, maxContactGap := processingConfig()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	dbClient := connectMongo(ctx, 1)
+	defer dbClient.Disconnect(context.Background())
+	db := dbClient.Database(mongoDBName)
+	provisionIndexes(ctx, db, indexMode)
+
+	lastProgress := time.Now()
+	report, err := positionevent.Reprocess(positionevent.ReprocessConfig{
+		Store:  positionevent.NewMongoStore(db),
+		Venues: venue.NewCache(venue.NewRepo(db.Collection("venue-config")), defaults, venueConfigTTL),
+		Rule:   distanceRule,
+		MaxGap: maxContactGap,
+		Venue:  *venueName,
+		From:   uint32(fromTime.UnixNano() / int64(time.Millisecond) / positionevent.TimeBucketSize),
+		To:     uint32(toTime.UnixNano() / int64(time.Millisecond) / positionevent.TimeBucketSize),
+		DryRun: *dryRun,
+		Progress: func(report positionevent.ReprocessReport) {
+			if time.Since(lastProgress) < reprocessProgressInterval {
+				return
+			}
+			lastProgress = time.Now()
+			log.Printf(
+				"Reprocessed %d of %d position events into %d minute aggregates, up to %s\n",
+				report.PositionEvents, report.Found.PositionEvents, report.MinuteAggregates, bucketTime(report.TimeBucket, report.BucketSize),
+			)
+		},
+	})
+	if err != nil {
+		dbClient.Disconnect(context.Background())
+		log.Fatal("Reprocessing failed, run it again to start over: ", err)
+	}
+
+	log.Printf(
+		"Time range of %s widened to %s - %s to cover whole contact events of %v time buckets\n",
+		report.Venue, bucketTime(report.From, report.BucketSize), bucketTime(report.To, report.BucketSize),
+		time.Duration(report.BucketSize)*time.Millisecond,
+	)
+	log.Printf(
+		"Found %d position events, %d minute aggregates and %d contact events\n",
+		report.Found.PositionEvents, report.Found.MinuteAggregates, report.Found.ContactEvents,
+	)
+	if report.DryRun {
+		log.Println("Dry run; nothing was changed")
+		return
+	}
+	log.Printf(
+		"Deleted %d minute aggregates and %d contact events, then reprocessed %d position events into %d minute aggregates\n",
+		report.Deleted.MinuteAggregates, report.Deleted.ContactEvents, report.PositionEvents, report.MinuteAggregates,
+	)
+}
+
+// bucketTime returns the start of a time bucket of bucketSize
+func bucketTime(timeBucket uint32, bucketSize int64) time.Time {
+	return time.Unix(0, int64(timeBucket)*bucketSize*int64(time.Millisecond)).UTC()
+}
@@ -6,5 +6,7 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gin-gonic/gin v1.6.3
 	github.com/joho/godotenv v1.3.0
+	github.com/prometheus/client_golang v1.7.1
+	github.com/segmentio/kafka-go v0.4.8
 	go.mongodb.org/mongo-driver v1.3.4
 )
@@ -30,6 +30,7 @@ func GetDeviceTokenHandler(signingKey string, deviceRepo device.Repo) gin.Handle
 			device.Venue,
 			jwt.StandardClaims{
 				ExpiresAt: expiresAt.UTC().Unix(),
+				Subject:   device.ID,
 			},
 		})
 
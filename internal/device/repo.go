@@ -2,6 +2,7 @@ package device
 
 import (
 	"context"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -12,6 +13,11 @@ type Device struct {
 	ID    string `json:"id" bson:"_id"`
 	Type  string `json:"type" bson:"type"`
 	Venue string `json:"venue" bson:"venue"`
+	// ClockOffset is how many milliseconds the clock of the device was
+	// ahead of the server when last measured, and ClockOffsetAt when it
+	// was measured to differ from the offset before
+	ClockOffset   int64     `json:"clockOffset,omitempty" bson:"clockOffset,omitempty"`
+	ClockOffsetAt time.Time `json:"clockOffsetAt,omitempty" bson:"clockOffsetAt,omitempty"`
 }
 
 type Repo interface {
@@ -19,6 +25,7 @@ type Repo interface {
 	Create(id string, deviceType string, venue string) (device *Device, err error)
 	Get(id string) (device *Device, err error)
 	Delete(id string) (deleted bool, err error)
+	SetClockOffset(id string, offset int64) (err error)
 }
 
 type repo struct {
@@ -86,3 +93,17 @@ func (d *repo) Delete(id string) (deleted bool, err error) {
 	deleted = result.DeletedCount > 0
 	return
 }
+
+func (d *repo) SetClockOffset(id string, offset int64) (err error) {
+	_, err = d.col.UpdateOne(
+		context.Background(),
+		bson.M{"_id": id},
+		bson.M{
+			"$set": bson.M{
+				"clockOffset":   offset,
+				"clockOffsetAt": time.Now().UTC(),
+			},
+		},
+	)
+	return
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"contact-monitoring-ingest-api/internal/indexes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Queue describes an in-process queue whose saturation is
+// reported by QueueCheck
+type Queue struct {
+	Name string
+	Len  func() int
+	Cap  int
+}
+
+type queueDetail struct {
+	Length     int     `json:"length"`
+	Capacity   int     `json:"capacity"`
+	Saturation float64 `json:"saturation"`
+}
+
+// MongoCheck returns a Check which pings the primary of client
+func MongoCheck(client *mongo.Client) Check {
+	return func(ctx context.Context) (detail interface{}, err error) {
+		return nil, client.Ping(ctx, readpref.Primary())
+	}
+}
+
+// IndexCheck returns a Check which fails when any of specs
+// does not exist in db or exists with different options
+func IndexCheck(db *mongo.Database, specs []indexes.Spec) Check {
+	return func(ctx context.Context) (detail interface{}, err error) {
+		problems, err := indexes.Verify(ctx, db, specs)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) > 0 {
+			return gin.H{"problems": problems}, fmt.Errorf("%d required indexes are missing or differ", len(problems))
+		}
+		return nil, nil
+	}
+}
+
+// QueueCheck returns a Check which reports how full each queue is and
+// fails when any of them is at or above maxSaturation, a ratio of
+// length to capacity. workers is reported as is so the pool sizes show
+// up alongside the queues they drain.
+func QueueCheck(queues []Queue, workers map[string]int, maxSaturation float64) Check {
+	return func(ctx context.Context) (detail interface{}, err error) {
+		details := make(map[string]queueDetail, len(queues))
+		var saturated []string
+		for _, queue := range queues {
+			length := queue.Len()
+			saturation := 0.0
+			if queue.Cap > 0 {
+				saturation = float64(length) / float64(queue.Cap)
+			}
+			details[queue.Name] = queueDetail{
+				Length:     length,
+				Capacity:   queue.Cap,
+				Saturation: saturation,
+			}
+			if saturation >= maxSaturation {
+				saturated = append(saturated, queue.Name)
+			}
+		}
+
+		detail = gin.H{
+			"queues":  details,
+			"workers": workers,
+		}
+		if len(saturated) > 0 {
+			return detail, fmt.Errorf("queues are saturated: %s", strings.Join(saturated, ", "))
+		}
+		return detail, nil
+	}
+}
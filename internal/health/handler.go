@@ -1,11 +1,24 @@
 package health
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Check reports on a single dependency of the service. A non nil error
+// means the service should not receive traffic. detail is included in the
+// readiness response either way.
+type Check func(ctx context.Context) (detail interface{}, err error)
+
+type checkResult struct {
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Detail interface{} `json:"detail,omitempty"`
+}
+
 // GetHandler returns a status which indicates
 // that the service is currently running
 func GetHandler() gin.HandlerFunc {
@@ -15,5 +28,34 @@ func GetHandler() gin.HandlerFunc {
 	}
 }
 
-// TODO: add more advanced health check which checks
-// health of DB and other external service dependencies
+// ReadyHandler returns a gin HandlerFunc which runs every check with the
+// given timeout and responds 200 when all of them pass or 503 otherwise,
+// along with the result of each check
+func ReadyHandler(timeout time.Duration, checks map[string]Check) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		status := http.StatusOK
+		results := make(map[string]checkResult, len(checks))
+		for name, check := range checks {
+			detail, err := check(ctx)
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				results[name] = checkResult{Status: "error", Error: err.Error(), Detail: detail}
+			} else {
+				results[name] = checkResult{Status: "ok", Detail: detail}
+			}
+		}
+
+		overall := "ok"
+		if status != http.StatusOK {
+			overall = "unavailable"
+		}
+
+		c.JSON(status, gin.H{
+			"status": overall,
+			"checks": results,
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func serveReady(checks map[string]Check) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/health/ready", ReadyHandler(time.Second, checks))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/health/ready", nil)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestReadyHandlerOK(t *testing.T) {
+	w := serveReady(map[string]Check{
+		"ok": func(ctx context.Context) (interface{}, error) { return nil, nil },
+	})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d but got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestReadyHandlerFailingCheck(t *testing.T) {
+	w := serveReady(map[string]Check{
+		"ok":     func(ctx context.Context) (interface{}, error) { return nil, nil },
+		"broken": func(ctx context.Context) (interface{}, error) { return nil, errors.New("unreachable") },
+	})
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestQueueCheckSaturation(t *testing.T) {
+	check := QueueCheck([]Queue{
+		{Name: "empty", Len: func() int { return 0 }, Cap: 10},
+		{Name: "full", Len: func() int { return 9 }, Cap: 10},
+	}, nil, 0.9)
+
+	if _, err := check(context.Background()); err == nil {
+		t.Errorf("expected a queue at 90%% to fail the check")
+	}
+}
@@ -0,0 +1,237 @@
+package indexes
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Spec describes an index the service relies on
+type Spec struct {
+	Collection string
+	Keys       bson.D
+	Unique     bool
+	// PartialFilter limits the index to documents matching it
+	PartialFilter bson.M
+	// SphereVersion is the 2dsphereIndexVersion of 2dsphere indexes
+	SphereVersion int32
+	// Weights and the language options only apply to text indexes
+	Weights          bson.M
+	DefaultLanguage  string
+	LanguageOverride string
+	TextVersion      int32
+}
+
+// Required lists the indexes from scripts/create_indexes.js. Duplicate
+// detection and the nearby query don't work correctly without them.
+var Required = []Spec{
+	{Collection: "contact-event", Keys: bson.D{{Key: "devices", Value: 1}, {Key: "end", Value: -1}, {Key: "start", Value: -1}}},
+	{Collection: "contact-event", Keys: bson.D{{Key: "devices", Value: 1}, {Key: "startTime", Value: 1}}},
+	{Collection: "contact-event", Keys: bson.D{{Key: "devices.0", Value: 1}, {Key: "devices.1", Value: 1}, {Key: "end", Value: -1}, {Key: "start", Value: -1}}, Unique: true},
+	{Collection: "contact-event", Keys: bson.D{{Key: "duration", Value: 1}}},
+	{Collection: "contact-event", Keys: bson.D{{Key: "end", Value: 1}}},
+	{Collection: "contact-event", Keys: bson.D{{Key: "mindistance", Value: 1}}},
+	{Collection: "contact-event", Keys: bson.D{{Key: "minuteaggregates", Value: 1}}},
+	{Collection: "contact-event", Keys: bson.D{{Key: "venue", Value: 1}, {Key: "end", Value: 1}}},
+	{Collection: "contact-change", Keys: bson.D{{Key: "seq", Value: 1}}},
+	{Collection: "contact-change", Keys: bson.D{{Key: "venue", Value: 1}, {Key: "seq", Value: 1}}},
+	{Collection: "contact-change", Keys: bson.D{{Key: "contact.end", Value: 1}}},
+	{Collection: "contact-lock", Keys: bson.D{{Key: "devices.0", Value: 1}, {Key: "devices.1", Value: 1}}, Unique: true},
+	{Collection: "contact-lock", Keys: bson.D{{Key: "end", Value: 1}}},
+	// the _id index every collection has, so that the counter collection
+	// transactions increment is created before them
+	{Collection: "counter", Keys: bson.D{{Key: "_id", Value: 1}}},
+	{Collection: "daily-exposure", Keys: bson.D{{Key: "devices.0", Value: 1}, {Key: "devices.1", Value: 1}, {Key: "day", Value: 1}}, Unique: true},
+	{Collection: "daily-exposure", Keys: bson.D{{Key: "devices", Value: 1}, {Key: "day", Value: 1}}},
+	{Collection: "daily-exposure", Keys: bson.D{{Key: "venues", Value: 1}, {Key: "start", Value: 1}}},
+	{Collection: "device", Keys: bson.D{{Key: "venue", Value: 1}}},
+	{
+		Collection:       "device",
+		Keys:             bson.D{{Key: "_fts", Value: "text"}, {Key: "_ftsx", Value: 1}},
+		Weights:          bson.M{"_id": 1, "deviceType": 1, "name": 1},
+		DefaultLanguage:  "english",
+		LanguageOverride: "language",
+		TextVersion:      3,
+	},
+	{Collection: "minute-aggregation", Keys: bson.D{{Key: "events.0.device", Value: 1}, {Key: "events.1.device", Value: 1}, {Key: "timeBucket", Value: -1}}, Unique: true},
+	{Collection: "minute-aggregation", Keys: bson.D{{Key: "events.device", Value: 1}, {Key: "timeBucket", Value: 1}}},
+	{Collection: "minute-aggregation", Keys: bson.D{{Key: "timeBucket", Value: 1}}},
+	{Collection: "minute-aggregation", Keys: bson.D{{Key: "venue", Value: 1}, {Key: "timeBucket", Value: 1}}},
+	{Collection: "minute-aggregation", Keys: bson.D{{Key: "pending", Value: 1}}, PartialFilter: bson.M{"pending": true}},
+	{Collection: "position-event", Keys: bson.D{{Key: "device", Value: 1}, {Key: "timeBucket", Value: 1}}, Unique: true},
+	{Collection: "position-event", Keys: bson.D{{Key: "lonlat", Value: "2dsphere"}, {Key: "floor", Value: 1}, {Key: "timeBucket", Value: -1}}, SphereVersion: 3},
+	{Collection: "position-event", Keys: bson.D{{Key: "timeBucket", Value: 1}, {Key: "venue", Value: 1}}},
+	{Collection: "position-event", Keys: bson.D{{Key: "venue", Value: 1}}},
+	{Collection: "position-event", Keys: bson.D{{Key: "pending", Value: 1}}, PartialFilter: bson.M{"pending": true}},
+	{Collection: "zone-occupancy", Keys: bson.D{{Key: "venue", Value: 1}, {Key: "bucketSize", Value: 1}, {Key: "timeBucket", Value: 1}, {Key: "zone", Value: 1}}, Unique: true},
+}
+
+// String returns a readable description of the index like
+// position-event{device: 1, timeBucket: 1}
+func (s Spec) String() string {
+	return s.Collection + keyString(s.Keys)
+}
+
+// options returns the options to create the index with
+func (s Spec) options() *options.IndexOptions {
+	opts := options.Index()
+	if s.Unique {
+		opts.SetUnique(true)
+	}
+	if s.PartialFilter != nil {
+		opts.SetPartialFilterExpression(s.PartialFilter)
+	}
+	if s.SphereVersion != 0 {
+		opts.SetSphereVersion(s.SphereVersion)
+	}
+	if s.Weights != nil {
+		opts.SetWeights(s.Weights)
+	}
+	if s.DefaultLanguage != "" {
+		opts.SetDefaultLanguage(s.DefaultLanguage)
+	}
+	if s.LanguageOverride != "" {
+		opts.SetLanguageOverride(s.LanguageOverride)
+	}
+	if s.TextVersion != 0 {
+		opts.SetTextVersion(s.TextVersion)
+	}
+	return opts
+}
+
+type existingIndex struct {
+	Name             string `bson:"name"`
+	Key              bson.D `bson:"key"`
+	Unique           bool   `bson:"unique"`
+	PartialFilter    bson.M `bson:"partialFilterExpression"`
+	SphereVersion    int32  `bson:"2dsphereIndexVersion"`
+	Weights          bson.M `bson:"weights"`
+	DefaultLanguage  string `bson:"default_language"`
+	LanguageOverride string `bson:"language_override"`
+	TextVersion      int32  `bson:"textIndexVersion"`
+}
+
+// differences describes how index differs from spec, or is
+// empty when they match
+func (index existingIndex) differences(spec Spec) (diffs []string) {
+	if index.Unique != spec.Unique {
+		diffs = append(diffs, fmt.Sprintf("unique is %v, expected %v", index.Unique, spec.Unique))
+	}
+	if !sameDocument(index.PartialFilter, spec.PartialFilter) {
+		diffs = append(diffs, fmt.Sprintf("partialFilterExpression is %v, expected %v", index.PartialFilter, spec.PartialFilter))
+	}
+	if spec.SphereVersion != 0 && index.SphereVersion != spec.SphereVersion {
+		diffs = append(diffs, fmt.Sprintf("2dsphereIndexVersion is %d, expected %d", index.SphereVersion, spec.SphereVersion))
+	}
+	if spec.Weights != nil && !sameDocument(index.Weights, spec.Weights) {
+		diffs = append(diffs, fmt.Sprintf("weights are %v, expected %v", index.Weights, spec.Weights))
+	}
+	if spec.DefaultLanguage != "" && index.DefaultLanguage != spec.DefaultLanguage {
+		diffs = append(diffs, fmt.Sprintf("default_language is %s, expected %s", index.DefaultLanguage, spec.DefaultLanguage))
+	}
+	if spec.LanguageOverride != "" && index.LanguageOverride != spec.LanguageOverride {
+		diffs = append(diffs, fmt.Sprintf("language_override is %s, expected %s", index.LanguageOverride, spec.LanguageOverride))
+	}
+	if spec.TextVersion != 0 && index.TextVersion != spec.TextVersion {
+		diffs = append(diffs, fmt.Sprintf("textIndexVersion is %d, expected %d", index.TextVersion, spec.TextVersion))
+	}
+	return
+}
+
+// Ensure creates every spec in specs that does not already exist in db.
+// Creating an index that already exists with the same options is a no-op
+// in mongo, while one that exists with different options is an error,
+// which is returned rather than silently dropping and rebuilding it.
+func Ensure(ctx context.Context, db *mongo.Database, specs []Spec) (err error) {
+	for _, spec := range specs {
+		_, err = db.Collection(spec.Collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    spec.Keys,
+			Options: spec.options(),
+		})
+		if err != nil {
+			return fmt.Errorf("creating index %s: %w", spec, err)
+		}
+	}
+	return nil
+}
+
+// Verify returns a description of each spec in specs that does not exist
+// in db or exists with different options
+func Verify(ctx context.Context, db *mongo.Database, specs []Spec) (problems []string, err error) {
+	existing := map[string][]existingIndex{}
+	for _, spec := range specs {
+		if _, ok := existing[spec.Collection]; ok {
+			continue
+		}
+
+		cursor, err := db.Collection(spec.Collection).Indexes().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var indexes []existingIndex
+		if err := cursor.All(ctx, &indexes); err != nil {
+			return nil, err
+		}
+		existing[spec.Collection] = indexes
+	}
+
+	for _, spec := range specs {
+		var index *existingIndex
+		for i := range existing[spec.Collection] {
+			if keyString(existing[spec.Collection][i].Key) == keyString(spec.Keys) {
+				index = &existing[spec.Collection][i]
+				break
+			}
+		}
+		if index == nil {
+			problems = append(problems, spec.String()+" is missing")
+		} else if diffs := index.differences(spec); len(diffs) > 0 {
+			problems = append(problems, spec.String()+" differs: "+strings.Join(diffs, "; "))
+		}
+	}
+
+	return problems, nil
+}
+
+// keyString formats an index key document so that numeric directions
+// compare equal whatever numeric type mongo returns them as
+func keyString(keys bson.D) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s: %v", key.Key, normalize(key.Value))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// sameDocument compares two documents, treating nil and empty as equal
+// and ignoring the numeric types of values
+func sameDocument(a bson.M, b bson.M) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		other, ok := b[key]
+		if !ok || !reflect.DeepEqual(normalize(value), normalize(other)) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return value
+}
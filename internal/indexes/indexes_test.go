@@ -0,0 +1,39 @@
+package indexes
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestKeyStringIgnoresNumericType(t *testing.T) {
+	existing := bson.D{{Key: "device", Value: int32(1)}, {Key: "timeBucket", Value: float64(-1)}}
+	spec := bson.D{{Key: "device", Value: 1}, {Key: "timeBucket", Value: -1}}
+
+	if keyString(existing) != keyString(spec) {
+		t.Errorf("expected %s to equal %s", keyString(existing), keyString(spec))
+	}
+}
+
+func TestDifferences(t *testing.T) {
+	spec := Spec{
+		Collection:    "position-event",
+		Keys:          bson.D{{Key: "pending", Value: 1}},
+		PartialFilter: bson.M{"pending": true},
+	}
+
+	matching := existingIndex{PartialFilter: bson.M{"pending": true}}
+	if diffs := matching.differences(spec); len(diffs) != 0 {
+		t.Errorf("expected no differences but got %v", diffs)
+	}
+
+	unique := existingIndex{Unique: true, PartialFilter: bson.M{"pending": true}}
+	if diffs := unique.differences(spec); len(diffs) != 1 {
+		t.Errorf("expected unique to differ but got %v", diffs)
+	}
+
+	unfiltered := existingIndex{}
+	if diffs := unfiltered.differences(spec); len(diffs) != 1 {
+		t.Errorf("expected partial filter to differ but got %v", diffs)
+	}
+}
@@ -0,0 +1,158 @@
+package positionevent
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+)
+
+// Broker carries position events from the API to the EventWorkers and
+// minute aggregates from the EventWorkers to the AggregateWorkers.
+//
+// Minute aggregates are partitioned by their pair of devices so the
+// minute aggregates of a pair are merged by one AggregateWorker in order.
+// Delivery is at most once: anything lost between publishing and being
+// acknowledged in the Store is picked up again by Replay and Redeliver.
+type Broker interface {
+	// PublishEvent hands event to the EventWorkers, waiting until ctx is done
+	PublishEvent(ctx context.Context, event PositionEvent) error
+	// PublishMinuteAggregate hands minAggregate to the AggregateWorker of
+	// its partition, waiting until ctx is done
+	PublishMinuteAggregate(ctx context.Context, minAggregate MinuteAggregate) error
+	// Events is consumed by the EventWorkers of this process
+	Events() <-chan PositionEvent
+	// MinuteAggregates is consumed by the AggregateWorker of partition
+	MinuteAggregates(partition int) <-chan MinuteAggregate
+	// Partitions is the number of minute aggregate partitions, and so of
+	// AggregateWorkers, in this process
+	Partitions() int
+	// CloseEvents stops delivering events and closes Events once the
+	// EventWorkers can no longer publish minute aggregates from them
+	CloseEvents()
+	// CloseMinuteAggregates stops delivering minute aggregates and closes
+	// the partitions; call it once the EventWorkers have stopped
+	CloseMinuteAggregates()
+	// Close releases the connections of the broker
+	Close() error
+}
+
+// pairKey is the partitioning key of a minute aggregate
+func pairKey(minAggregate MinuteAggregate) string {
+	return minAggregate.Events[0].DeviceID + "/" + minAggregate.Events[1].DeviceID
+}
+
+// localQueues are the buffered channels the workers of this process
+// consume from, whichever Broker feeds them
+type localQueues struct {
+	events     chan PositionEvent
+	partitions []chan MinuteAggregate
+	seed       maphash.Seed
+
+	closeEvents     sync.Once
+	closeAggregates sync.Once
+}
+
+func newLocalQueues(eventBuffer int, partitions int, partitionBuffer int) *localQueues {
+	q := &localQueues{
+		events:     make(chan PositionEvent, eventBuffer),
+		partitions: make([]chan MinuteAggregate, partitions),
+		seed:       maphash.MakeSeed(),
+	}
+	for i := range q.partitions {
+		q.partitions[i] = make(chan MinuteAggregate, partitionBuffer)
+	}
+	return q
+}
+
+func (q *localQueues) pushEvent(ctx context.Context, event PositionEvent) error {
+	select {
+	case q.events <- event:
+		return nil
+	default:
+	}
+
+	select {
+	case q.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pushMinuteAggregate puts minAggregate on the partition of its devices
+func (q *localQueues) pushMinuteAggregate(ctx context.Context, minAggregate MinuteAggregate) error {
+	var h maphash.Hash
+	h.SetSeed(q.seed)
+	h.WriteString(pairKey(minAggregate))
+	partition := q.partitions[h.Sum64()%uint64(len(q.partitions))]
+
+	select {
+	case partition <- minAggregate:
+		return nil
+	default:
+	}
+
+	select {
+	case partition <- minAggregate:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *localQueues) Events() <-chan PositionEvent {
+	return q.events
+}
+
+func (q *localQueues) MinuteAggregates(partition int) <-chan MinuteAggregate {
+	return q.partitions[partition]
+}
+
+func (q *localQueues) Partitions() int {
+	return len(q.partitions)
+}
+
+func (q *localQueues) closeEventQueue() {
+	q.closeEvents.Do(func() {
+		close(q.events)
+	})
+}
+
+func (q *localQueues) closeMinuteAggregateQueues() {
+	q.closeAggregates.Do(func() {
+		for _, partition := range q.partitions {
+			close(partition)
+		}
+	})
+}
+
+// ChannelBroker is a Broker within a single process backed by channels
+type ChannelBroker struct {
+	*localQueues
+}
+
+// NewChannelBroker returns a ChannelBroker buffering eventBuffer events
+// and partitionBuffer minute aggregates in each of partitions partitions
+func NewChannelBroker(eventBuffer int, partitions int, partitionBuffer int) *ChannelBroker {
+	return &ChannelBroker{newLocalQueues(eventBuffer, partitions, partitionBuffer)}
+}
+
+func (b *ChannelBroker) PublishEvent(ctx context.Context, event PositionEvent) error {
+	return b.pushEvent(ctx, event)
+}
+
+func (b *ChannelBroker) PublishMinuteAggregate(ctx context.Context, minAggregate MinuteAggregate) error {
+	return b.pushMinuteAggregate(ctx, minAggregate)
+}
+
+func (b *ChannelBroker) CloseEvents() {
+	b.closeEventQueue()
+}
+
+func (b *ChannelBroker) CloseMinuteAggregates() {
+	b.closeMinuteAggregateQueues()
+}
+
+func (b *ChannelBroker) Close() error {
+	return nil
+}
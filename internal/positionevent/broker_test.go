@@ -0,0 +1,103 @@
+package positionevent
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pairAggregate(a string, b string, bucket uint32) MinuteAggregate {
+	return MinuteAggregate{
+		TimeBucket: bucket,
+		Events:     [2]PartialPositionEvent{{DeviceID: a}, {DeviceID: b}},
+	}
+}
+
+func TestChannelBrokerKeepsPairOnOnePartition(t *testing.T) {
+	broker := NewChannelBroker(1, 4, 10)
+
+	for bucket := uint32(0); bucket < 5; bucket++ {
+		if err := broker.PublishMinuteAggregate(context.Background(), pairAggregate("a", "b", bucket)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < broker.Partitions(); i++ {
+		depth := len(broker.MinuteAggregates(i))
+		if depth != 0 && depth != 5 {
+			t.Errorf("expected the pair to be on a single partition but partition %d has %d", i, depth)
+		}
+	}
+}
+
+func TestChannelBrokerTimesOutWhenFull(t *testing.T) {
+	broker := NewChannelBroker(1, 1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := broker.PublishEvent(ctx, PositionEvent{DeviceID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.PublishEvent(ctx, PositionEvent{DeviceID: "b"}); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded when full but got %v", err)
+	}
+}
+
+// TestKafkaBrokerRoundTrip runs against the brokers at KAFKA_TEST_BROKERS,
+// which need to create topics automatically
+func TestKafkaBrokerRoundTrip(t *testing.T) {
+	brokers := os.Getenv("KAFKA_TEST_BROKERS")
+	if brokers == "" {
+		t.Skip("set KAFKA_TEST_BROKERS to run against kafka")
+	}
+
+	suffix := time.Now().Format("20060102150405.000000")
+	broker := NewKafkaBroker(KafkaBrokerConfig{
+		Brokers:                 strings.Split(brokers, ","),
+		EventTopic:              "test-events-" + suffix,
+		MinuteAggregateTopic:    "test-minute-aggregates-" + suffix,
+		GroupID:                 "test-" + suffix,
+		ConsumeEvents:           true,
+		ConsumeMinuteAggregates: true,
+		EventBuffer:             10,
+		Partitions:              2,
+		PartitionBuffer:         10,
+	})
+	defer broker.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := broker.PublishEvent(ctx, PositionEvent{DeviceID: "a", TimeBucket: 100}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-broker.Events():
+		if event.DeviceID != "a" || event.TimeBucket != 100 {
+			t.Errorf("expected the published event but got %v", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for event")
+	}
+
+	if err := broker.PublishMinuteAggregate(ctx, pairAggregate("a", "b", 100)); err != nil {
+		t.Fatal(err)
+	}
+	received := false
+	for !received {
+		select {
+		case minAggregate := <-broker.MinuteAggregates(0):
+			received = minAggregate.TimeBucket == 100
+		case minAggregate := <-broker.MinuteAggregates(1):
+			received = minAggregate.TimeBucket == 100
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for minute aggregate")
+		}
+	}
+
+	broker.CloseEvents()
+	broker.CloseMinuteAggregates()
+}
@@ -0,0 +1,47 @@
+package positionevent
+
+import (
+	"math"
+	"time"
+)
+
+// bucketSizeOf returns the length in milliseconds of the time buckets of a
+// record stored with size, which is TimeBucketSize for records stored
+// before venues could configure their own
+func bucketSizeOf(size int64) int64 {
+	if size == 0 {
+		return TimeBucketSize
+	}
+	return size
+}
+
+// bucketMinutes returns the length in minutes of a time bucket of size
+func bucketMinutes(size int64) float64 {
+	return float64(bucketSizeOf(size)) / float64(time.Minute.Milliseconds())
+}
+
+// defaultBucket returns the time bucket of TimeBucketSize that
+// timeBucket of size starts in
+func defaultBucket(timeBucket uint32, size int64) uint32 {
+	return clampBucket(int64(timeBucket) * bucketSizeOf(size) / TimeBucketSize)
+}
+
+// bucketRange returns the time buckets of size that overlap the range
+// [from, to] of time buckets of TimeBucketSize
+func bucketRange(from uint32, to uint32, size int64) (uint32, uint32) {
+	size = bucketSizeOf(size)
+	return clampBucket(int64(from) * TimeBucketSize / size),
+		clampBucket(((int64(to)+1)*TimeBucketSize - 1) / size)
+}
+
+// gapBuckets returns how many whole time buckets of size fit in maxGap
+func gapBuckets(maxGap time.Duration, size int64) uint32 {
+	return clampBucket(maxGap.Milliseconds() / bucketSizeOf(size))
+}
+
+func clampBucket(bucket int64) uint32 {
+	if bucket > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(bucket)
+}
@@ -0,0 +1,103 @@
+package positionevent
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ContactChange records a closed contact event being changed by a late
+// minute aggregate, eg. from a device that uploaded its positions after
+// being offline, so whoever read the contact event knows to read it again
+type ContactChange struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	// Seq numbers the changes in the order they were committed, which
+	// ids created before their transaction commits don't
+	Seq     int64     `bson:"seq" json:"seq"`
+	Devices [2]string `bson:"devices" json:"devices"`
+	Venue   string    `bson:"venue,omitempty" json:"venue,omitempty"`
+	// TimeBucket is the time bucket of the late minute aggregate, of the
+	// size of Contact.BucketSize
+	TimeBucket uint32 `bson:"timeBucket" json:"timeBucket"`
+	// Replaced are the ids of the contact events that were merged into
+	// Contact, at least one of which was closed
+	Replaced  []primitive.ObjectID `bson:"replaced" json:"replaced"`
+	Contact   ContactEvent         `bson:"contact" json:"contact"`
+	ChangedAt time.Time            `bson:"changedAt" json:"changedAt"`
+}
+
+// newContactChange returns the change record of merging contact into
+// neighbours as merged if any of the neighbours ended before closedBefore
+func newContactChange(contact ContactEvent, neighbours []ContactEvent, merged ContactEvent, closedBefore uint32) (change ContactChange, changed bool) {
+	for _, neighbour := range neighbours {
+		if neighbour.End < closedBefore {
+			changed = true
+		}
+		change.Replaced = append(change.Replaced, neighbour.ID)
+	}
+
+	change.Devices = contact.Devices
+	change.Venue = contact.Venue
+	change.TimeBucket = contact.Start
+	change.Contact = merged
+	change.ChangedAt = time.Now().UTC()
+	return change, changed
+}
+
+// ContactChangeQuery describes a filter over contact changes. Changes
+// with a Seq after After are returned, so a consumer can poll with the Seq
+// of the last change it has seen. Since and Venue are ignored when zero.
+type ContactChangeQuery struct {
+	After int64
+	Since time.Time
+	Venue string
+	Limit int64
+}
+
+// ChangeRepo is an interface for reading contact changes
+// from their persistence layer
+type ChangeRepo interface {
+	FindChanges(query ContactChangeQuery) (changes []ContactChange, err error)
+}
+
+type changeRepo struct {
+	col *mongo.Collection
+}
+
+// NewChangeRepo returns a new ChangeRepo interface
+func NewChangeRepo(col *mongo.Collection) ChangeRepo {
+	return &changeRepo{
+		col,
+	}
+}
+
+// FindChanges returns up to query.Limit contact changes committed after
+// query.After, oldest first
+func (r *changeRepo) FindChanges(query ContactChangeQuery) (changes []ContactChange, err error) {
+	filter := bson.M{
+		"seq": bson.M{"$gt": query.After},
+	}
+	if !query.Since.IsZero() {
+		filter["changedAt"] = bson.M{"$gte": query.Since}
+	}
+	if query.Venue != "" {
+		filter["venue"] = query.Venue
+	}
+
+	cursor, err := r.col.Find(
+		context.Background(),
+		filter,
+		options.Find().SetSort(bson.M{"seq": 1}).SetLimit(query.Limit),
+	)
+	if err != nil {
+		return
+	}
+
+	changes = []ContactChange{}
+	err = cursor.All(context.Background(), &changes)
+	return
+}
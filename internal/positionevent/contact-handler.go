@@ -0,0 +1,242 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultContactLimit int64 = 100
+const maxContactLimit int64 = 1000
+
+const defaultGraphHops = 2
+const maxGraphHops = 5
+
+type contactQueryParams struct {
+	Device      string  `form:"device" binding:"required"`
+	From        *int64  `form:"from" binding:"required"`
+	To          int64   `form:"to"`
+	MinDuration int     `form:"minDuration"`
+	MaxDistance float64 `form:"maxDistance"`
+	Venue       string  `form:"venue"`
+	Offset      int64   `form:"offset"`
+	Limit       int64   `form:"limit"`
+}
+
+type dailyExposureQueryParams struct {
+	Device     string `form:"device" binding:"required"`
+	From       *int64 `form:"from" binding:"required"`
+	To         int64  `form:"to"`
+	MinMinutes int    `form:"minMinutes"`
+}
+
+type contactChangeQueryParams struct {
+	After int64  `form:"after"`
+	From  int64  `form:"from"`
+	Venue string `form:"venue"`
+	Limit int64  `form:"limit"`
+}
+
+type graphQueryParams struct {
+	Device      string  `form:"device" binding:"required"`
+	From        *int64  `form:"from" binding:"required"`
+	To          int64   `form:"to"`
+	Hops        int     `form:"hops"`
+	MinDuration int     `form:"minDuration"`
+	MaxDistance float64 `form:"maxDistance"`
+	Venue       string  `form:"venue"`
+}
+
+// GetContactsHandler returns a gin HandlerFunc which lists the contact
+// events of the device provided by the device query param. from and to
+// are epoch milliseconds like PositionEvent.Time; to defaults to now.
+// minDuration defaults to the minimum contact duration of the venue
+// query param, or of the deployment when no venue is given.
+func GetContactsHandler(contactRepo ContactRepo, venues venue.Configs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params contactQueryParams
+		if err := c.ShouldBindQuery(&params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if params.To == 0 {
+			params.To = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		if params.To < *params.From {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+			return
+		}
+		if params.Offset < 0 || params.Limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset and limit must not be negative"})
+			return
+		}
+		if params.MinDuration == 0 {
+			params.MinDuration = venues.For(params.Venue).MinContactDuration
+		}
+		if params.Limit == 0 {
+			params.Limit = defaultContactLimit
+		} else if params.Limit > maxContactLimit {
+			params.Limit = maxContactLimit
+		}
+
+		contacts, err := contactRepo.Find(ContactQuery{
+			Device:      params.Device,
+			From:        uint32(*params.From / TimeBucketSize),
+			To:          uint32(params.To / TimeBucketSize),
+			MinDuration: params.MinDuration,
+			MaxDistance: params.MaxDistance,
+			Venue:       params.Venue,
+			Offset:      params.Offset,
+			Limit:       params.Limit,
+		})
+		if err != nil {
+			log.Println("error finding contact events", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to find contact events"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"contacts": contacts,
+			"offset":   params.Offset,
+			"limit":    params.Limit,
+		})
+	}
+}
+
+// GetContactGraphHandler returns a gin HandlerFunc which walks the contact
+// events outward from the device query param up to hops degrees of contact
+// and returns the exposure graph of devices and the contacts between them
+func GetContactGraphHandler(contactRepo ContactRepo, venues venue.Configs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params graphQueryParams
+		if err := c.ShouldBindQuery(&params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if params.To == 0 {
+			params.To = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		if params.To < *params.From {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+			return
+		}
+		if params.MinDuration == 0 {
+			params.MinDuration = venues.For(params.Venue).MinContactDuration
+		}
+		if params.Hops == 0 {
+			params.Hops = defaultGraphHops
+		}
+		if params.Hops < 0 || params.Hops > maxGraphHops {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("hops must be between 1 and %d", maxGraphHops)})
+			return
+		}
+
+		graph, err := BuildExposureGraph(contactRepo, GraphQuery{
+			Device:      params.Device,
+			From:        uint32(*params.From / TimeBucketSize),
+			To:          uint32(params.To / TimeBucketSize),
+			Hops:        params.Hops,
+			MinDuration: params.MinDuration,
+			MaxDistance: params.MaxDistance,
+			Venue:       params.Venue,
+		})
+		if err == ErrGraphTooLarge {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println("error building exposure graph", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to build exposure graph"})
+			return
+		}
+
+		c.JSON(http.StatusOK, graph)
+	}
+}
+
+// GetDailyExposuresHandler returns a gin HandlerFunc which lists the
+// cumulative contact per UTC day between the device query param and each
+// device it was in contact with. from and to are epoch milliseconds;
+// to defaults to now.
+func GetDailyExposuresHandler(exposureRepo ExposureRepo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params dailyExposureQueryParams
+		if err := c.ShouldBindQuery(&params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if params.To == 0 {
+			params.To = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		if params.To < *params.From {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+			return
+		}
+
+		exposures, err := exposureRepo.FindDaily(DailyExposureQuery{
+			Device:     params.Device,
+			From:       dayOf(uint32(*params.From/TimeBucketSize), TimeBucketSize),
+			To:         dayOf(uint32(params.To/TimeBucketSize), TimeBucketSize),
+			MinMinutes: params.MinMinutes,
+		})
+		if err != nil {
+			log.Println("error finding daily exposures", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to find daily exposures"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"exposures": exposures})
+	}
+}
+
+// GetContactChangesHandler returns a gin HandlerFunc which lists the
+// changes late data made to closed contact events, oldest first. Changes
+// are listed after the after query param, the seq of the last change the
+// caller has seen, and from epoch milliseconds when given.
+func GetContactChangesHandler(changeRepo ChangeRepo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params contactChangeQueryParams
+		if err := c.ShouldBindQuery(&params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var since time.Time
+		if params.From > 0 {
+			since = time.Unix(0, params.From*int64(time.Millisecond))
+		}
+		if params.Limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must not be negative"})
+			return
+		}
+		if params.Limit == 0 {
+			params.Limit = defaultContactLimit
+		} else if params.Limit > maxContactLimit {
+			params.Limit = maxContactLimit
+		}
+
+		changes, err := changeRepo.FindChanges(ContactChangeQuery{
+			After: params.After,
+			Since: since,
+			Venue: params.Venue,
+			Limit: params.Limit,
+		})
+		if err != nil {
+			log.Println("error finding contact changes", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to find contact changes"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"changes": changes,
+			"limit":   params.Limit,
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package positionevent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetContactsHandlerAcceptsFromZero(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/contacts", GetContactsHandler(NewMemoryStore(), testVenues))
+
+	for query, status := range map[string]int{
+		"?device=a&from=0": http.StatusOK,
+		"?device=a":        http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/contacts"+query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("expected %s to get %d but got %d: %s", query, status, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package positionevent
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bucketsPerDay is how many time buckets of TimeBucketSize make up a UTC day
+const bucketsPerDay = uint32(int64(24*time.Hour/time.Millisecond) / TimeBucketSize)
+
+// dayOf returns the UTC day since epoch a time bucket of size falls on
+func dayOf(timeBucket uint32, size int64) uint32 {
+	return defaultBucket(timeBucket, size) / bucketsPerDay
+}
+
+// DailyExposure is the cumulative contact between two devices over a UTC
+// day, however many separate contact events it was spread across
+type DailyExposure struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Devices [2]string          `bson:"devices" json:"devices"`
+	// Day is the number of UTC days since epoch
+	Day uint32 `bson:"day" json:"day"`
+	// Start is the first time bucket of TimeBucketSize of Day
+	Start uint32 `bson:"start" json:"start"`
+	// Minutes is how many minutes the devices were in contact
+	// and ExposureMinutes how many minutes they are expected to
+	// have been within the contact distance
+	Minutes         float64  `bson:"minutes" json:"minutes"`
+	ExposureMinutes float64  `bson:"exposureMinutes" json:"exposureMinutes"`
+	Venues          []string `bson:"venues,omitempty" json:"venues,omitempty"`
+}
+
+// DailyExposureQuery describes a filter over the daily exposures of a
+// single device. From and To are days since epoch and MinMinutes is
+// ignored when zero.
+type DailyExposureQuery struct {
+	Device     string
+	From       uint32
+	To         uint32
+	MinMinutes int
+}
+
+// ExposureRepo is an interface for reading daily exposures
+// from their persistence layer
+type ExposureRepo interface {
+	FindDaily(query DailyExposureQuery) (exposures []DailyExposure, err error)
+}
+
+type exposureRepo struct {
+	col *mongo.Collection
+}
+
+// NewExposureRepo returns a new ExposureRepo interface
+func NewExposureRepo(col *mongo.Collection) ExposureRepo {
+	return &exposureRepo{
+		col,
+	}
+}
+
+// FindDaily returns the daily exposures involving query.Device between
+// query.From and query.To, sorted by day
+func (r *exposureRepo) FindDaily(query DailyExposureQuery) (exposures []DailyExposure, err error) {
+	filter := bson.M{
+		"devices": query.Device,
+		"day": bson.M{
+			"$gte": query.From,
+			"$lte": query.To,
+		},
+	}
+	if query.MinMinutes > 0 {
+		filter["minutes"] = bson.M{"$gte": query.MinMinutes}
+	}
+
+	cursor, err := r.col.Find(
+		context.Background(),
+		filter,
+		options.Find().SetSort(bson.D{{Key: "day", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return
+	}
+
+	exposures = []DailyExposure{}
+	err = cursor.All(context.Background(), &exposures)
+	return
+}
@@ -0,0 +1,166 @@
+package positionevent
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxGraphNodes bounds how many devices a single traversal may visit so a
+// busy venue can't turn one request into a scan of the whole collection
+const maxGraphNodes = 5000
+
+const graphPageSize int64 = 500
+
+// ErrGraphTooLarge is returned when an exposure graph traversal would
+// visit more than maxGraphNodes devices
+var ErrGraphTooLarge = errors.New("exposure graph exceeds maximum number of devices")
+
+// GraphQuery describes an exposure graph traversal starting from Device.
+// From and To are time buckets of TimeBucketSize, Hops is how many degrees
+// of contact to follow and MinDuration is in minutes.
+type GraphQuery struct {
+	Device      string
+	From        uint32
+	To          uint32
+	Hops        int
+	MinDuration int
+	MaxDistance float64
+	Venue       string
+}
+
+// GraphNode is a device reached by an exposure graph traversal. ExposedAt
+// is the earliest time bucket of TimeBucketSize the exposure could have
+// reached the device.
+type GraphNode struct {
+	Device    string `json:"device"`
+	Hop       int    `json:"hop"`
+	ExposedAt uint32 `json:"exposedAt"`
+}
+
+// GraphEdge is a summary of the ContactEvent that carried an exposure
+// from Source to Target. Start and End are the time buckets of
+// TimeBucketSize the contact started and ended in, and Duration is
+// in minutes.
+type GraphEdge struct {
+	ID          primitive.ObjectID `json:"id"`
+	Source      string             `json:"source"`
+	Target      string             `json:"target"`
+	Start       uint32             `json:"start"`
+	End         uint32             `json:"end"`
+	Duration    float64            `json:"duration"`
+	MinDistance float64            `json:"minDistance"`
+	// ExposureMinutes is the expected number of minutes in contact
+	ExposureMinutes float64 `json:"exposureMinutes"`
+	Hop             int     `json:"hop"`
+}
+
+// ExposureGraph is the result of an exposure graph traversal
+type ExposureGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// BuildExposureGraph walks the contact events breadth first from
+// query.Device up to query.Hops degrees of contact. A contact only carries
+// an exposure forward if it ended at or after the time the source device
+// was itself exposed, so contacts of contacts that happened before the
+// first exposure are ignored.
+func BuildExposureGraph(contactRepo ContactRepo, query GraphQuery) (graph ExposureGraph, err error) {
+	nodes := map[string]*GraphNode{
+		query.Device: {Device: query.Device, Hop: 0, ExposedAt: query.From},
+	}
+	order := []string{query.Device}
+	seenEdges := map[primitive.ObjectID]bool{}
+	frontier := []string{query.Device}
+
+	for hop := 1; hop <= query.Hops && len(frontier) > 0; hop++ {
+		var next []string
+		for _, device := range frontier {
+			source := nodes[device]
+			contacts, err := findAllContacts(contactRepo, ContactQuery{
+				Device:      device,
+				From:        source.ExposedAt,
+				To:          query.To,
+				MinDuration: query.MinDuration,
+				MaxDistance: query.MaxDistance,
+				Venue:       query.Venue,
+			})
+			if err != nil {
+				return graph, err
+			}
+
+			for _, contact := range contacts {
+				if seenEdges[contact.ID] {
+					continue
+				}
+				seenEdges[contact.ID] = true
+
+				target := contact.Devices[0]
+				if target == device {
+					target = contact.Devices[1]
+				}
+
+				graph.Edges = append(graph.Edges, GraphEdge{
+					ID:              contact.ID,
+					Source:          device,
+					Target:          target,
+					Start:           defaultBucket(contact.Start, contact.BucketSize),
+					End:             defaultBucket(contact.End, contact.BucketSize),
+					Duration:        contact.Duration,
+					MinDistance:     contact.MinDistance,
+					ExposureMinutes: contact.ExposureMinutes,
+					Hop:             hop,
+				})
+
+				exposedAt := defaultBucket(contact.Start, contact.BucketSize)
+				if exposedAt < source.ExposedAt {
+					exposedAt = source.ExposedAt
+				}
+
+				node, ok := nodes[target]
+				if !ok {
+					if len(nodes) >= maxGraphNodes {
+						return graph, ErrGraphTooLarge
+					}
+					nodes[target] = &GraphNode{Device: target, Hop: hop, ExposedAt: exposedAt}
+					order = append(order, target)
+					next = append(next, target)
+				} else if exposedAt < node.ExposedAt && node.Hop > 0 {
+					// an earlier exposure widens the window for this device's
+					// own contacts so it is walked again from the earlier time,
+					// and its hop is that of the path that exposed it earlier
+					node.ExposedAt = exposedAt
+					node.Hop = hop
+					next = append(next, target)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	graph.Nodes = make([]GraphNode, len(order))
+	for i, device := range order {
+		graph.Nodes[i] = *nodes[device]
+	}
+	if graph.Edges == nil {
+		graph.Edges = []GraphEdge{}
+	}
+
+	return graph, nil
+}
+
+func findAllContacts(contactRepo ContactRepo, query ContactQuery) (contacts []ContactEvent, err error) {
+	query.Limit = graphPageSize
+	for {
+		page, err := contactRepo.Find(query)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, page...)
+		if int64(len(page)) < query.Limit {
+			return contacts, nil
+		}
+		query.Offset += query.Limit
+	}
+}
@@ -0,0 +1,113 @@
+package positionevent
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type fakeContactRepo struct {
+	contacts []ContactEvent
+}
+
+func (r *fakeContactRepo) Find(query ContactQuery) (contacts []ContactEvent, err error) {
+	var matches []ContactEvent
+	for _, contact := range r.contacts {
+		if contact.Devices[0] != query.Device && contact.Devices[1] != query.Device {
+			continue
+		}
+		if contact.End < query.From || contact.Start > query.To {
+			continue
+		}
+		matches = append(matches, contact)
+	}
+	if query.Offset >= int64(len(matches)) {
+		return []ContactEvent{}, nil
+	}
+	matches = matches[query.Offset:]
+	if query.Limit > 0 && int64(len(matches)) > query.Limit {
+		matches = matches[:query.Limit]
+	}
+	return matches, nil
+}
+
+func newContact(a string, b string, start uint32, end uint32) ContactEvent {
+	return ContactEvent{
+		ID:       primitive.NewObjectID(),
+		Devices:  [2]string{a, b},
+		Start:    start,
+		End:      end,
+		Duration: float64(end-start) + 1,
+	}
+}
+
+func TestBuildExposureGraphHonorsTimeOrdering(t *testing.T) {
+	repo := &fakeContactRepo{contacts: []ContactEvent{
+		newContact("a", "b", 100, 110),
+		// c met b before b was exposed by a so c is not exposed
+		newContact("b", "c", 50, 60),
+		// d met b after b was exposed by a
+		newContact("b", "d", 120, 130),
+		// e met d after d was exposed but is 3 hops away
+		newContact("d", "e", 140, 150),
+	}}
+
+	graph, err := BuildExposureGraph(repo, GraphQuery{Device: "a", From: 0, To: 1000, Hops: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hops := map[string]int{}
+	for _, node := range graph.Nodes {
+		hops[node.Device] = node.Hop
+	}
+
+	expected := map[string]int{"a": 0, "b": 1, "d": 2}
+	if len(hops) != len(expected) {
+		t.Errorf("expected nodes %v but got %v", expected, hops)
+	}
+	for device, hop := range expected {
+		if h, ok := hops[device]; !ok || h != hop {
+			t.Errorf("expected %s at hop %d but got %v", device, hop, hops)
+		}
+	}
+
+	if len(graph.Edges) != 2 {
+		t.Errorf("expected 2 edges but got %d", len(graph.Edges))
+	}
+}
+
+func TestBuildExposureGraphExposedAtUsesContactStart(t *testing.T) {
+	repo := &fakeContactRepo{contacts: []ContactEvent{
+		newContact("a", "b", 100, 110),
+	}}
+
+	graph, err := BuildExposureGraph(repo, GraphQuery{Device: "a", From: 10, To: 1000, Hops: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(graph.Nodes) != 2 || graph.Nodes[1].ExposedAt != 100 {
+		t.Errorf("expected b to be exposed at 100 but got %v", graph.Nodes)
+	}
+}
+
+func TestBuildExposureGraphHopMatchesEarliestExposure(t *testing.T) {
+	repo := &fakeContactRepo{contacts: []ContactEvent{
+		// c is reached directly, but only after it was exposed through b
+		newContact("a", "c", 300, 310),
+		newContact("a", "b", 100, 110),
+		newContact("b", "c", 150, 160),
+	}}
+
+	graph, err := BuildExposureGraph(repo, GraphQuery{Device: "a", From: 0, To: 1000, Hops: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range graph.Nodes {
+		if node.Device == "c" && (node.ExposedAt != 150 || node.Hop != 2) {
+			t.Errorf("expected c exposed at 150 on hop 2 but got %+v", node)
+		}
+	}
+}
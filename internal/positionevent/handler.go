@@ -2,53 +2,120 @@ package positionevent
 
 import (
 	"contact-monitoring-ingest-api/internal/auth"
+	"contact-monitoring-ingest-api/internal/device"
+	"contact-monitoring-ingest-api/internal/venue"
 	"context"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func positionEventProcessor(
 	event PositionEvent,
-	col *mongo.Collection,
-	eventChan chan PositionEvent,
+	config PostHandlerConfig,
 ) httpResponse {
 	if event.UserConsent != true {
+		positionEventsTotal.WithLabelValues(resultConsent).Inc()
 		return httpResponse{
 			Message: "userConsent was not set to true so the event was ignored",
 			Status:  http.StatusBadRequest,
 		}
 	}
 
-	res, err := col.InsertOne(context.Background(), event)
+	// the event stays pending until an EventWorker has processed it
+	event.Pending = true
+	var id primitive.ObjectID
+	var err error
+	replaced := false
+	if config.Selection.replaces() {
+		event.Quality = config.Selection.quality(event)
+		id, replaced, err = config.Store.UpsertEvent(event)
+	} else {
+		id, err = config.Store.InsertEvent(event)
+		if err == ErrDuplicate {
+			// a measured position always wins over an interpolated one
+			id, err = config.Store.ReplaceInterpolatedEvent(event)
+			replaced = err == nil
+		}
+	}
 
 	if err != nil {
-		if merr, ok := err.(mongo.WriteException); ok {
-			// single duplicate key error which we are ok with
-			if len(merr.WriteErrors) == 1 && merr.WriteErrors[0].Code == 11000 {
-				return httpResponse{
-					Message: "There is already a position for this device at this time",
-					Status:  http.StatusConflict,
-				}
+		// duplicate error which we are ok with
+		if err == ErrDuplicate {
+			positionEventsTotal.WithLabelValues(resultDuplicate).Inc()
+			return httpResponse{
+				Message: "There is already a position for this device at this time",
+				Status:  http.StatusConflict,
 			}
 		}
 
 		log.Println("error inserting position event", err)
+		positionEventsTotal.WithLabelValues(resultError).Inc()
 		return httpResponse{
 			Message: "An unexpected server error has occured",
 			Status:  http.StatusInternalServerError,
 		}
 	}
 
-	event.ID = res.InsertedID.(primitive.ObjectID)
-	eventChan <- event
+	event.ID = id
+	var remerge []MinuteAggregate
+	if replaced {
+		// the minute aggregates of the replaced event are derived again
+		// from event by the EventWorker
+		remerge, err = config.Store.DeleteEventDerived(event)
+		if err != nil {
+			// the event stays pending without being published, so Replay
+			// deletes them before it derives them again
+			log.Println("error deleting minute aggregates of replaced position event", err)
+			positionEventsTotal.WithLabelValues(resultError).Inc()
+			return httpResponse{
+				Message: "The position could not be processed yet; retry later",
+				Status:  http.StatusServiceUnavailable,
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.QueueTimeout)
+	defer cancel()
+	if err := config.Broker.PublishEvent(ctx, event); err != nil && replaced {
+		// the event it replaced is gone so it can't be rolled back; it
+		// stays pending for Redeliver instead
+		log.Println("error publishing replacing position event; deferring", err)
+	} else if err != nil {
+		// the workers can't keep up so roll back the insert and have the
+		// device send the event again later rather than stall the request
+		log.Println("error publishing position event", err)
+		if err := config.Store.DeleteEvent(id); err != nil {
+			log.Println("error deleting position event after enqueue timeout", err)
+		}
+		positionEventsTotal.WithLabelValues(resultQueueFull).Inc()
+		return httpResponse{
+			Message: "The event queue is full; retry later",
+			Status:  http.StatusServiceUnavailable,
+		}
+	}
+
+	// the other minute aggregates of the contact events deleted with them
+	// are merged again, or left pending for Redeliver when the broker
+	// doesn't take them in time
+	for _, minAggregate := range remerge {
+		if err := config.Broker.PublishMinuteAggregate(ctx, minAggregate); err != nil {
+			log.Println("error publishing minute aggregate to merge again; deferring", err)
+			break
+		}
+	}
 
+	if replaced {
+		positionEventsTotal.WithLabelValues(resultReplaced).Inc()
+	} else {
+		positionEventsTotal.WithLabelValues(resultAccepted).Inc()
+	}
 	return httpResponse{
 		Status: http.StatusOK,
 	}
@@ -59,16 +126,71 @@ type httpResponse struct {
 	Status  int    `json:"status"`
 }
 
-const timeBucketSize int64 = 60 * 1000 // 60 seconds in milliseconds
+// TimeBucketSize is the length of a time bucket in milliseconds of the
+// records stored before venues could configure their own, and of the time
+// buckets that queries across venues are given in
+const TimeBucketSize int64 = 60 * 1000 // 60 seconds in milliseconds
+
+// retryAfterSeconds is sent in the Retry-After header when any event
+// in a batch was turned away because the event queue was full
+const retryAfterSeconds = "30"
+
+// SentAtHeader is the optional header in which devices send the time, in
+// epoch milliseconds by their own clock, that they sent a batch of events
+const SentAtHeader = "X-Sent-At"
+
+// clockOffsetTolerance is how many milliseconds apart the clocks of a
+// device and the server can be without correcting the device, since the
+// sent at time is already off by the latency of the request
+const clockOffsetTolerance int64 = 1000
+
+// PostHandlerConfig defines configuration values for a PostHandler
+type PostHandlerConfig struct {
+	Store  Store
+	Broker Broker
+	Venues venue.Configs
+	// Devices, when set, keeps the clock offset of each device so the
+	// time of their events is corrected for it
+	Devices device.Repo
+	// QueueTimeout is how long to wait for the broker to accept an event
+	QueueTimeout time.Duration
+	// MaxClockSkew is how far ahead of the server the time of an event
+	// can be before it is rejected
+	MaxClockSkew time.Duration
+	// AllowedLateness is how far behind the server the time of an event
+	// can be before it is rejected; events are never too late when zero
+	AllowedLateness time.Duration
+	// Selection decides which of the events of a device in a time bucket
+	// is processed; the zero value is FirstSelection
+	Selection SelectionStrategy
+	// InterpolationMaxGap is how long a gap between the positions of a
+	// device can be for events to be interpolated across it; gaps are
+	// never interpolated when zero
+	InterpolationMaxGap time.Duration
+}
 
 // PostHandler accepts a body of an array of position.Events
 // it determines the best fit of those events to process by selecting
-// the events nearest to each time bucket
-func PostHandler(
-	col *mongo.Collection,
-	eventChan chan PositionEvent,
-	accuracyThreshold float64,
-) gin.HandlerFunc {
+// one event, or the centroid of them, per time bucket with
+// config.Selection. Unless that is FirstSelection, the selected event
+// also replaces a stored event of lower quality in its time bucket, and
+// whatever the strategy it replaces a stored interpolated event.
+// When the broker doesn't accept an event within config.QueueTimeout the
+// event being processed gets a 503 and the rest of the batch a 429
+// so the device can send them again later. Events from further in the
+// future than config.MaxClockSkew get a 422 and events older than
+// config.AllowedLateness a 410, so the device can drop them.
+//
+// The time of events is corrected by the clock offset of the device, which
+// is measured against the SentAtHeader whenever a device sends it.
+//
+// With config.InterpolationMaxGap set, the time buckets missing between an
+// accepted event and the previous event of the device are filled with
+// interpolated events, so devices that send positions less often than
+// every time bucket don't miss contacts.
+//
+// Events are tagged with the zone of the venue they are in, if any.
+func PostHandler(config PostHandlerConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		claims, ok := c.Get("claims")
 		if !ok {
@@ -98,37 +220,167 @@ func PostHandler(
 			return events[i].Time < events[j].Time
 		})
 
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		offset, err := clockOffset(config.Devices, venueClaims.Subject, c.GetHeader(SentAtHeader), now)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": SentAtHeader + " must be epoch milliseconds"})
+			return
+		}
+		if offset != 0 {
+			for i := range events {
+				// the offset is measured for, and stored on, the device
+				// of the token
+				if venueClaims.Subject != "" && events[i].DeviceID != venueClaims.Subject {
+					continue
+				}
+				events[i].RawTime = events[i].Time
+				events[i].ClockOffset = offset
+				events[i].Time -= offset
+			}
+		}
+
 		// only process events that have good enough accuracy
 		// and are closest to the time bucket
+		venueConfig := config.Venues.For(venueClaims.Venue)
+		accuracyThreshold := venueConfig.AccuracyThreshold
+		bucketSize := bucketSizeOf(venueConfig.TimeBucketSize)
 		response := make([]httpResponse, len(events))
-		var currentBucket uint32 = 0
+		// indexes of the events to select from in each time bucket
+		var buckets [][]int
+		saturated := false
 		for i, event := range events {
-			event.TimeBucket = uint32(math.Round(float64(event.Time / timeBucketSize)))
+			event.TimeBucket = uint32(math.Round(float64(event.Time / bucketSize)))
+			event.BucketSize = bucketSize
+			if event.Time <= now {
+				positionEventLateness.Observe(float64(now-event.Time) / 1000)
+			}
+
 			if event.Venue != venueClaims.Venue {
+				positionEventsTotal.WithLabelValues(resultVenueMismatch).Inc()
 				response[i] = httpResponse{
 					Message: fmt.Sprintf("Unauthorized venue %v specified; token only has access to %v", event.Venue, venueClaims.Venue),
 					Status:  http.StatusUnauthorized,
 				}
+			} else if event.Time > now+config.MaxClockSkew.Milliseconds() {
+				// the device clock is ahead so its time buckets can't be trusted
+				positionEventsTotal.WithLabelValues(resultFuture).Inc()
+				response[i] = httpResponse{
+					Message: fmt.Sprintf("Time %d is more than %v ahead of the server; check the device clock", event.Time, config.MaxClockSkew),
+					Status:  http.StatusUnprocessableEntity,
+				}
+			} else if config.AllowedLateness > 0 && event.Time < now-config.AllowedLateness.Milliseconds() {
+				positionEventsTotal.WithLabelValues(resultLate).Inc()
+				response[i] = httpResponse{
+					Message: fmt.Sprintf("Time %d is more than the allowed lateness of %v behind the server", event.Time, config.AllowedLateness),
+					Status:  http.StatusGone,
+				}
 			} else if float64(event.Accuracy) > accuracyThreshold {
 				// filter out events that don't have good enough accuracy
+				positionEventsTotal.WithLabelValues(resultAccuracy).Inc()
 				response[i] = httpResponse{
 					Message: fmt.Sprintf("Accuracy of %f exceeds threshold of %f", event.Accuracy, accuracyThreshold),
 					Status:  http.StatusBadRequest,
 				}
-			} else if event.TimeBucket != currentBucket {
-				// if we are looking at a newer time bucket then use this event
-				currentBucket = event.TimeBucket
-				response[i] = positionEventProcessor(event, col, eventChan)
 			} else {
-				// we already have an event for this time bucket so return conflict
-				response[i] = httpResponse{
-					Message: "There is already a position for this device at this time",
-					Status:  http.StatusConflict,
+				// the events are sorted so a bucket's events are consecutive
+				if len(buckets) == 0 || events[buckets[len(buckets)-1][0]].TimeBucket != event.TimeBucket {
+					buckets = append(buckets, nil)
 				}
+				buckets[len(buckets)-1] = append(buckets[len(buckets)-1], i)
+				events[i] = event
 			}
 		}
 
+		for _, bucket := range buckets {
+			if saturated {
+				// the queue already timed out for this batch so don't wait again
+				for _, i := range bucket {
+					positionEventsTotal.WithLabelValues(resultThrottled).Inc()
+					response[i] = httpResponse{
+						Message: "The event queue is full; retry later",
+						Status:  http.StatusTooManyRequests,
+					}
+				}
+				continue
+			}
+
+			candidates := make([]PositionEvent, len(bucket))
+			for j, i := range bucket {
+				candidates[j] = events[i]
+			}
+			used, event := config.Selection.selectEvent(candidates)
+			event.Zone = zoneOf(venueConfig, event)
+			processed := positionEventProcessor(event, config)
+			if processed.Status == http.StatusServiceUnavailable {
+				saturated = true
+			}
+			if processed.Status == http.StatusOK && config.InterpolationMaxGap > 0 {
+				interpolateGap(event, config)
+			}
+
+			for j, i := range bucket {
+				if containsIndex(used, j) {
+					if len(used) > 1 && processed.Status == http.StatusOK {
+						// the event went into the centroid
+						positionEventsTotal.WithLabelValues(resultCombined).Inc()
+					}
+					response[i] = processed
+				} else {
+					// another event was selected for this time bucket, or the
+					// centroid left it out, so return conflict
+					positionEventsTotal.WithLabelValues(resultDuplicate).Inc()
+					response[i] = httpResponse{
+						Message: "There is already a position for this device at this time",
+						Status:  http.StatusConflict,
+					}
+				}
+			}
+		}
+
+		if saturated {
+			c.Header("Retry-After", retryAfterSeconds)
+		}
 		c.JSON(http.StatusMultiStatus, response)
 		c.Done()
 	}
 }
+
+// clockOffset returns how many milliseconds the clock of deviceID is ahead
+// of the server. It is measured from sentAt, when the device sent it, and
+// stored on the device for the batches it sends without it when it changed.
+func clockOffset(devices device.Repo, deviceID string, sentAt string, receivedAt int64) (offset int64, err error) {
+	measured := false
+	if sentAt != "" {
+		sent, err := strconv.ParseInt(sentAt, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		offset = sent - receivedAt
+		if offset > -clockOffsetTolerance && offset < clockOffsetTolerance {
+			offset = 0
+		}
+		measured = true
+	}
+
+	// the offset of tokens issued before they named their device can't be
+	// stored, so they are only corrected when they send the header
+	if devices == nil || deviceID == "" {
+		return offset, nil
+	}
+
+	d, err := devices.Get(deviceID)
+	if err != nil {
+		log.Println("error getting device clock offset", err)
+		return offset, nil
+	}
+	if !measured {
+		return d.ClockOffset, nil
+	}
+
+	if offset != d.ClockOffset {
+		if err := devices.SetClockOffset(deviceID, offset); err != nil {
+			log.Println("error storing device clock offset", err)
+		}
+	}
+	return offset, nil
+}
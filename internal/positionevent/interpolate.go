@@ -0,0 +1,98 @@
+package positionevent
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// interpolateEvents returns an interpolated event for each time bucket
+// between previous and event, positioned as if the device had moved in a
+// straight line between them at a constant speed. The floor only changes
+// half way, as a device crossing floors is on one or the other.
+func interpolateEvents(previous PositionEvent, event PositionEvent) []PositionEvent {
+	var events []PositionEvent
+	bucketSize := bucketSizeOf(event.BucketSize)
+	for bucket := previous.TimeBucket + 1; bucket < event.TimeBucket; bucket++ {
+		// the start of the bucket falls strictly between the two events
+		t := int64(bucket) * bucketSize
+		f := float64(t-previous.Time) / float64(event.Time-previous.Time)
+
+		floor := previous.Floor
+		if f >= 0.5 {
+			floor = event.Floor
+		}
+
+		interpolated := event
+		interpolated.ID = primitive.NilObjectID
+		interpolated.Time = t
+		interpolated.TimeBucket = bucket
+		interpolated.LonLat[0] = previous.LonLat[0] + f*(event.LonLat[0]-previous.LonLat[0])
+		interpolated.LonLat[1] = previous.LonLat[1] + f*(event.LonLat[1]-previous.LonLat[1])
+		interpolated.Accuracy = previous.Accuracy + float32(f)*(event.Accuracy-previous.Accuracy)
+		interpolated.Floor = floor
+		interpolated.RawTime = 0
+		interpolated.ClockOffset = 0
+		interpolated.Interpolated = true
+		events = append(events, interpolated)
+	}
+	return events
+}
+
+// interpolateGap stores and publishes interpolated events for the time
+// buckets between event and the last event of its device before it, when
+// there are any and they span no more than config.InterpolationMaxGap.
+// Gaps before an interpolated event are left alone, as are gaps across
+// venues.
+//
+// Interpolated events that the broker doesn't accept in time are left
+// pending for Redeliver rather than turning event away, and once one
+// isn't accepted the rest aren't published either.
+func interpolateGap(event PositionEvent, config PostHandlerConfig) {
+	previous, err := config.Store.LastEvent(event.DeviceID, event.BucketSize, event.TimeBucket)
+	if err != nil {
+		log.Println("error finding previous position event", err)
+		return
+	}
+	if previous == nil || previous.Interpolated || previous.Venue != event.Venue || !previous.UserConsent {
+		return
+	}
+
+	gap := int64(event.TimeBucket - previous.TimeBucket - 1)
+	if gap == 0 || gap*bucketSizeOf(event.BucketSize) > config.InterpolationMaxGap.Milliseconds() {
+		return
+	}
+
+	venueConfig := config.Venues.For(event.Venue)
+	publish := true
+	for _, interpolated := range interpolateEvents(*previous, event) {
+		interpolated.Pending = true
+		interpolated.Zone = zoneOf(venueConfig, interpolated)
+		id, err := config.Store.InsertEvent(interpolated)
+		if err != nil {
+			if err == ErrDuplicate {
+				positionEventsInterpolated.WithLabelValues(resultDuplicate).Inc()
+			} else {
+				log.Println("error inserting interpolated position event", err)
+				positionEventsInterpolated.WithLabelValues(resultError).Inc()
+			}
+			continue
+		}
+		interpolated.ID = id
+
+		if publish {
+			ctx, cancel := context.WithTimeout(context.Background(), config.QueueTimeout)
+			if err := config.Broker.PublishEvent(ctx, interpolated); err != nil {
+				log.Println("error publishing interpolated position event; deferring", err)
+				publish = false
+			}
+			cancel()
+		}
+		if !publish {
+			positionEventsInterpolated.WithLabelValues(resultQueueFull).Inc()
+			continue
+		}
+		positionEventsInterpolated.WithLabelValues(resultInserted).Inc()
+	}
+}
@@ -0,0 +1,202 @@
+package positionevent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// kafkaBatchTimeout bounds how long a publish waits for other
+// messages to batch with, since every publish waits for its write
+const kafkaBatchTimeout = 10 * time.Millisecond
+
+// kafkaCommitInterval is how often the offsets of the messages handed to
+// the local queues are committed, rather than waiting on every message
+const kafkaCommitInterval = time.Second
+
+// the suffixes of the consumer groups of each topic
+const (
+	eventGroupSuffix     = "-events"
+	aggregateGroupSuffix = "-aggregates"
+)
+
+// KafkaBrokerConfig defines configuration values for a KafkaBroker
+type KafkaBrokerConfig struct {
+	Brokers              []string
+	EventTopic           string
+	MinuteAggregateTopic string
+	// GroupID prefixes the consumer groups shared by every process
+	// consuming the topics. Each topic has its own group so a slow
+	// consumer of one doesn't rebalance the other.
+	GroupID string
+	// ConsumeEvents and ConsumeMinuteAggregates decide which topics
+	// this process consumes into its local queues
+	ConsumeEvents           bool
+	ConsumeMinuteAggregates bool
+	EventBuffer             int
+	Partitions              int
+	PartitionBuffer         int
+}
+
+// KafkaBroker is a Broker backed by a Kafka compatible cluster so the API,
+// EventWorkers and AggregateWorkers can run in separate processes. Events
+// are keyed by device and minute aggregates by their pair of devices, so a
+// pair is always consumed by one process, which partitions them again
+// between its AggregateWorkers.
+type KafkaBroker struct {
+	*localQueues
+	eventWriter     *kafka.Writer
+	aggregateWriter *kafka.Writer
+
+	stopEvents     context.CancelFunc
+	stopAggregates context.CancelFunc
+	eventsWG       sync.WaitGroup
+	aggregatesWG   sync.WaitGroup
+}
+
+// NewKafkaBroker returns a KafkaBroker which starts consuming the
+// topics that config asks for right away
+func NewKafkaBroker(config KafkaBrokerConfig) *KafkaBroker {
+	b := &KafkaBroker{
+		localQueues: newLocalQueues(config.EventBuffer, config.Partitions, config.PartitionBuffer),
+		eventWriter: &kafka.Writer{
+			Addr:         kafka.TCP(config.Brokers...),
+			Topic:        config.EventTopic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: kafkaBatchTimeout,
+			RequiredAcks: kafka.RequireAll,
+		},
+		aggregateWriter: &kafka.Writer{
+			Addr:         kafka.TCP(config.Brokers...),
+			Topic:        config.MinuteAggregateTopic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: kafkaBatchTimeout,
+			RequiredAcks: kafka.RequireAll,
+		},
+		stopEvents:     func() {},
+		stopAggregates: func() {},
+	}
+
+	if config.ConsumeEvents {
+		var ctx context.Context
+		ctx, b.stopEvents = context.WithCancel(context.Background())
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:        config.Brokers,
+			GroupID:        config.GroupID + eventGroupSuffix,
+			Topic:          config.EventTopic,
+			CommitInterval: kafkaCommitInterval,
+		})
+		b.eventsWG.Add(1)
+		go b.consume(ctx, reader, &b.eventsWG, func(value []byte) error {
+			var event PositionEvent
+			if err := bson.Unmarshal(value, &event); err != nil {
+				return err
+			}
+			return b.pushEvent(ctx, event)
+		})
+	}
+
+	if config.ConsumeMinuteAggregates {
+		var ctx context.Context
+		ctx, b.stopAggregates = context.WithCancel(context.Background())
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:        config.Brokers,
+			GroupID:        config.GroupID + aggregateGroupSuffix,
+			Topic:          config.MinuteAggregateTopic,
+			CommitInterval: kafkaCommitInterval,
+		})
+		b.aggregatesWG.Add(1)
+		go b.consume(ctx, reader, &b.aggregatesWG, func(value []byte) error {
+			var minAggregate MinuteAggregate
+			if err := bson.Unmarshal(value, &minAggregate); err != nil {
+				return err
+			}
+			return b.pushMinuteAggregate(ctx, minAggregate)
+		})
+	}
+
+	return b
+}
+
+// consume reads messages from reader and hands them to push until ctx is
+// done. Offsets are committed once messages are in the local queues, so a
+// message read but not handed over when the process stops is consumed
+// again by another process, while messages still in the local queues are
+// left to Redeliver.
+func (b *KafkaBroker) consume(ctx context.Context, reader *kafka.Reader, wg *sync.WaitGroup, push func(value []byte) error) {
+	defer wg.Done()
+	defer reader.Close()
+
+	for {
+		message, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("error reading from", reader.Config().Topic, err)
+			}
+			return
+		}
+
+		if err := push(message.Value); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// a message that can't be decoded never will be, so it is
+			// committed and skipped
+			log.Println("error decoding message from", reader.Config().Topic, err)
+		}
+
+		if err := reader.CommitMessages(ctx, message); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("error committing offset of", reader.Config().Topic, err)
+		}
+	}
+}
+
+func (b *KafkaBroker) PublishEvent(ctx context.Context, event PositionEvent) error {
+	value, err := bson.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.eventWriter.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.DeviceID),
+		Value: value,
+	})
+}
+
+func (b *KafkaBroker) PublishMinuteAggregate(ctx context.Context, minAggregate MinuteAggregate) error {
+	value, err := bson.Marshal(minAggregate)
+	if err != nil {
+		return err
+	}
+	return b.aggregateWriter.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(pairKey(minAggregate)),
+		Value: value,
+	})
+}
+
+func (b *KafkaBroker) CloseEvents() {
+	b.stopEvents()
+	b.eventsWG.Wait()
+	b.closeEventQueue()
+}
+
+func (b *KafkaBroker) CloseMinuteAggregates() {
+	b.stopAggregates()
+	b.aggregatesWG.Wait()
+	b.closeMinuteAggregateQueues()
+}
+
+func (b *KafkaBroker) Close() error {
+	eventErr := b.eventWriter.Close()
+	aggregateErr := b.aggregateWriter.Close()
+	if eventErr != nil {
+		return eventErr
+	}
+	return aggregateErr
+}
@@ -0,0 +1,675 @@
+package positionevent
+
+import (
+	"bytes"
+	"contact-monitoring-ingest-api/pkg/geo"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is a Store kept entirely in memory. It enforces the same
+// uniqueness rules as the indexes in scripts/create_indexes.js so the
+// pipeline behaves the same as it does against mongo. It is meant for
+// tests and for running the pipeline without a database.
+type MemoryStore struct {
+	mu               sync.Mutex
+	events           []PositionEvent
+	eventKeys        map[string]bool
+	minuteAggregates []MinuteAggregate
+	aggregateKeys    map[string]bool
+	contacts         []ContactEvent
+	dailyExposures   []DailyExposure
+	contactChanges   []ContactChange
+	changeSeq        int64
+	occupancies      []ZoneOccupancy
+	leases           map[string]Lease
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		eventKeys:     map[string]bool{},
+		aggregateKeys: map[string]bool{},
+		leases:        map[string]Lease{},
+	}
+}
+
+func (s *MemoryStore) InsertEvent(event PositionEvent) (id primitive.ObjectID, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%d", event.DeviceID, event.TimeBucket)
+	if s.eventKeys[key] {
+		return id, ErrDuplicate
+	}
+	s.eventKeys[key] = true
+
+	event.ID = primitive.NewObjectID()
+	s.events = append(s.events, event)
+	return event.ID, nil
+}
+
+func (s *MemoryStore) UpsertEvent(event PositionEvent) (id primitive.ObjectID, replaced bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%d", event.DeviceID, event.TimeBucket)
+	if !s.eventKeys[key] {
+		s.eventKeys[key] = true
+		event.ID = primitive.NewObjectID()
+		s.events = append(s.events, event)
+		return event.ID, false, nil
+	}
+
+	for i, e := range s.events {
+		if e.DeviceID != event.DeviceID || e.TimeBucket != event.TimeBucket {
+			continue
+		}
+		if e.Quality != 0 && e.Quality >= event.Quality && !e.Interpolated {
+			return id, false, ErrDuplicate
+		}
+		event.ID = e.ID
+		s.events[i] = event
+		return event.ID, true, nil
+	}
+	return id, false, ErrDuplicate
+}
+
+func (s *MemoryStore) ReplaceInterpolatedEvent(event PositionEvent) (id primitive.ObjectID, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.events {
+		if e.DeviceID == event.DeviceID && e.TimeBucket == event.TimeBucket && e.Interpolated {
+			event.ID = e.ID
+			s.events[i] = event
+			return event.ID, nil
+		}
+	}
+	return id, ErrDuplicate
+}
+
+func (s *MemoryStore) DeleteEvent(id primitive.ObjectID) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.events {
+		if e.ID == id {
+			delete(s.eventKeys, fmt.Sprintf("%s/%d", e.DeviceID, e.TimeBucket))
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteEventDerived(event PositionEvent) (remerge []MinuteAggregate, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	derived := map[primitive.ObjectID]bool{}
+	for _, m := range s.minuteAggregates {
+		if m.TimeBucket == event.TimeBucket && (m.Events[0].ID == event.ID || m.Events[1].ID == event.ID) {
+			derived[m.ID] = true
+		}
+	}
+	if len(derived) == 0 {
+		return
+	}
+
+	merged := map[primitive.ObjectID]bool{}
+	contacts := s.contacts[:0]
+	for _, contact := range s.contacts {
+		if containsAny(contact.MinuteAggregates, derived) {
+			for _, id := range contact.MinuteAggregates {
+				merged[id] = true
+			}
+			continue
+		}
+		contacts = append(contacts, contact)
+	}
+	s.contacts = contacts
+
+	var removed []MinuteAggregate
+	minAggregates := s.minuteAggregates[:0]
+	for _, m := range s.minuteAggregates {
+		if merged[m.ID] || derived[m.ID] {
+			removed = append(removed, m)
+		}
+		if derived[m.ID] {
+			delete(s.aggregateKeys, fmt.Sprintf("%s/%s/%d", m.Events[0].DeviceID, m.Events[1].DeviceID, m.TimeBucket))
+			continue
+		}
+		if merged[m.ID] {
+			m.Pending = true
+			remerge = append(remerge, m)
+		}
+		minAggregates = append(minAggregates, m)
+	}
+	s.minuteAggregates = minAggregates
+	s.subtractExposures(mergedExposures(removed, merged))
+	return
+}
+
+func containsAny(ids []primitive.ObjectID, set map[primitive.ObjectID]bool) bool {
+	for _, id := range ids {
+		if set[id] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) FindNearby(event PositionEvent, floors []int16, radius float64) (events []PositionEvent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.events {
+		if e.ID != event.ID &&
+			containsFloor(floors, e.Floor) &&
+			e.TimeBucket == event.TimeBucket &&
+			bucketSizeOf(e.BucketSize) == bucketSizeOf(event.BucketSize) &&
+			geo.Distance(e.LonLat, event.LonLat) <= radius {
+			events = append(events, e)
+		}
+	}
+	return
+}
+
+func (s *MemoryStore) LastEvent(device string, bucketSize int64, before uint32) (event *PositionEvent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.events {
+		if e.DeviceID != device || bucketSizeOf(e.BucketSize) != bucketSizeOf(bucketSize) || e.TimeBucket >= before {
+			continue
+		}
+		if event == nil || e.TimeBucket > event.TimeBucket {
+			last := s.events[i]
+			event = &last
+		}
+	}
+	return
+}
+
+func (s *MemoryStore) AckEvent(id primitive.ObjectID) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.events {
+		if s.events[i].ID == id {
+			s.events[i].Pending = false
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) PendingEvents(after primitive.ObjectID, before primitive.ObjectID, limit int64) (events []PositionEvent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.events {
+		if e.Pending && isBetween(e.ID, after, before) {
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return bytes.Compare(events[i].ID[:], events[j].ID[:]) < 0
+	})
+	if int64(len(events)) > limit {
+		events = events[:limit]
+	}
+	return
+}
+
+func (s *MemoryStore) InsertMinuteAggregate(minAggregate MinuteAggregate) (id primitive.ObjectID, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%s/%d", minAggregate.Events[0].DeviceID, minAggregate.Events[1].DeviceID, minAggregate.TimeBucket)
+	if s.aggregateKeys[key] {
+		return id, ErrDuplicate
+	}
+	s.aggregateKeys[key] = true
+
+	minAggregate.ID = primitive.NewObjectID()
+	s.minuteAggregates = append(s.minuteAggregates, minAggregate)
+	return minAggregate.ID, nil
+}
+
+func (s *MemoryStore) AckMinuteAggregate(id primitive.ObjectID) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.minuteAggregates {
+		if s.minuteAggregates[i].ID == id {
+			s.minuteAggregates[i].Pending = false
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) PendingMinuteAggregates(after primitive.ObjectID, before primitive.ObjectID, limit int64) (minAggregates []MinuteAggregate, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.minuteAggregates {
+		if m.Pending && isBetween(m.ID, after, before) {
+			minAggregates = append(minAggregates, m)
+		}
+	}
+	sort.Slice(minAggregates, func(i, j int) bool {
+		return bytes.Compare(minAggregates[i].ID[:], minAggregates[j].ID[:]) < 0
+	})
+	if int64(len(minAggregates)) > limit {
+		minAggregates = minAggregates[:limit]
+	}
+	return
+}
+
+func isBetween(id primitive.ObjectID, after primitive.ObjectID, before primitive.ObjectID) bool {
+	return bytes.Compare(id[:], after[:]) > 0 && bytes.Compare(id[:], before[:]) < 0
+}
+
+func (s *MemoryStore) MergeContact(contact ContactEvent, maxGap uint32, closedBefore uint32) (merged ContactEvent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.containsMinuteAggregate(contact.MinuteAggregates) {
+		return
+	}
+	for _, existing := range s.contacts {
+		if existing.Devices == contact.Devices && containsAll(existing.MinuteAggregates, contact.MinuteAggregates) {
+			return existing, nil
+		}
+	}
+
+	from, to := mergeWindow(contact, maxGap)
+	var neighbours []ContactEvent
+	remaining := s.contacts[:0]
+	for _, existing := range s.contacts {
+		if existing.Devices == contact.Devices && sameBucketSize(existing, contact) && existing.End >= from && existing.Start <= to {
+			neighbours = append(neighbours, existing)
+			continue
+		}
+		remaining = append(remaining, existing)
+	}
+
+	merged = mergeContacts(contact, neighbours)
+	merged.ID = primitive.NewObjectID()
+	s.contacts = append(remaining, merged)
+
+	if change, changed := newContactChange(contact, neighbours, merged, closedBefore); changed {
+		s.changeSeq++
+		change.ID = primitive.NewObjectID()
+		change.Seq = s.changeSeq
+		s.contactChanges = append(s.contactChanges, change)
+	}
+
+	s.addDailyExposure(contact)
+	return merged, nil
+}
+
+func (s *MemoryStore) containsMinuteAggregate(ids []primitive.ObjectID) bool {
+	for _, m := range s.minuteAggregates {
+		for _, id := range ids {
+			if m.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) addDailyExposure(contact ContactEvent) {
+	day := dayOf(contact.Start, contact.BucketSize)
+	for i := range s.dailyExposures {
+		exposure := &s.dailyExposures[i]
+		if exposure.Devices == contact.Devices && exposure.Day == day {
+			exposure.Minutes += contact.Duration
+			exposure.ExposureMinutes += contact.ExposureMinutes
+			if contact.Venue != "" && !containsString(exposure.Venues, contact.Venue) {
+				exposure.Venues = append(exposure.Venues, contact.Venue)
+			}
+			return
+		}
+	}
+
+	exposure := DailyExposure{
+		ID:              primitive.NewObjectID(),
+		Devices:         contact.Devices,
+		Day:             day,
+		Start:           day * bucketsPerDay,
+		Minutes:         contact.Duration,
+		ExposureMinutes: contact.ExposureMinutes,
+	}
+	if contact.Venue != "" {
+		exposure.Venues = []string{contact.Venue}
+	}
+	s.dailyExposures = append(s.dailyExposures, exposure)
+}
+
+func (s *MemoryStore) RecordOccupancy(event PositionEvent) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketSize := bucketSizeOf(event.BucketSize)
+	recorded := false
+	for i := range s.occupancies {
+		occupancy := &s.occupancies[i]
+		if occupancy.Venue != event.Venue || occupancy.BucketSize != bucketSize || occupancy.TimeBucket != event.TimeBucket {
+			continue
+		}
+		if occupancy.Zone == event.Zone {
+			if !containsString(occupancy.Devices, event.DeviceID) {
+				occupancy.Devices = append(occupancy.Devices, event.DeviceID)
+			}
+			recorded = true
+			continue
+		}
+		for j, device := range occupancy.Devices {
+			if device == event.DeviceID {
+				occupancy.Devices = append(occupancy.Devices[:j:j], occupancy.Devices[j+1:]...)
+				break
+			}
+		}
+	}
+
+	if !recorded && event.Zone != "" {
+		s.occupancies = append(s.occupancies, ZoneOccupancy{
+			ID:         primitive.NewObjectID(),
+			Venue:      event.Venue,
+			Zone:       event.Zone,
+			Floor:      event.Floor,
+			TimeBucket: event.TimeBucket,
+			BucketSize: bucketSize,
+			Devices:    []string{event.DeviceID},
+		})
+	}
+	return nil
+}
+
+func (s *MemoryStore) AcquireLease(name string, holder string, ttl time.Duration) (acquired bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if lease, ok := s.leases[name]; ok && lease.Holder != holder && lease.Expires.After(now) {
+		return false, nil
+	}
+	s.leases[name] = Lease{Name: name, Holder: holder, Expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *MemoryStore) FindOccupancy(query OccupancyQuery) (occupancies []ZoneOccupancy, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	occupancies = []ZoneOccupancy{}
+	for _, occupancy := range s.occupancies {
+		if occupancy.Venue == query.Venue &&
+			occupancy.BucketSize == query.BucketSize &&
+			occupancy.TimeBucket >= query.From &&
+			occupancy.TimeBucket <= query.To &&
+			(query.Zone == "" || occupancy.Zone == query.Zone) {
+			occupancy.Devices = append([]string(nil), occupancy.Devices...)
+			occupancies = append(occupancies, occupancy)
+		}
+	}
+
+	sort.Slice(occupancies, func(i, j int) bool {
+		if occupancies[i].Zone != occupancies[j].Zone {
+			return occupancies[i].Zone < occupancies[j].Zone
+		}
+		return occupancies[i].TimeBucket < occupancies[j].TimeBucket
+	})
+	return
+}
+
+func (s *MemoryStore) FindDaily(query DailyExposureQuery) (exposures []DailyExposure, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exposures = []DailyExposure{}
+	for _, exposure := range s.dailyExposures {
+		if exposure.Devices[0] != query.Device && exposure.Devices[1] != query.Device {
+			continue
+		}
+		if exposure.Day < query.From || exposure.Day > query.To {
+			continue
+		}
+		if query.MinMinutes > 0 && exposure.Minutes < float64(query.MinMinutes) {
+			continue
+		}
+		exposures = append(exposures, exposure)
+	}
+
+	sort.Slice(exposures, func(i, j int) bool {
+		return exposures[i].Day < exposures[j].Day
+	})
+	return exposures, nil
+}
+
+func containsAll(ids []primitive.ObjectID, wanted []primitive.ObjectID) bool {
+	for _, w := range wanted {
+		found := false
+		for _, id := range ids {
+			if id == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFloor(floors []int16, floor int16) bool {
+	for _, f := range floors {
+		if f == floor {
+			return true
+		}
+	}
+	return false
+}
+
+func sameBucketSize(a ContactEvent, b ContactEvent) bool {
+	return bucketSizeOf(a.BucketSize) == bucketSizeOf(b.BucketSize)
+}
+
+func containsString(values []string, wanted string) bool {
+	for _, v := range values {
+		if v == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) Find(query ContactQuery) (contacts []ContactEvent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	contacts = []ContactEvent{}
+	for _, contact := range s.contacts {
+		if contact.Devices[0] != query.Device && contact.Devices[1] != query.Device {
+			continue
+		}
+		from, to := bucketRange(query.From, query.To, contact.BucketSize)
+		if contact.End < from || contact.Start > to {
+			continue
+		}
+		if query.MinDuration > 0 && contact.Duration < float64(query.MinDuration) {
+			continue
+		}
+		if query.MaxDistance > 0 && contact.MinDistance > query.MaxDistance {
+			continue
+		}
+		if query.Venue != "" && contact.Venue != query.Venue {
+			continue
+		}
+		contacts = append(contacts, contact)
+	}
+
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].StartTime < contacts[j].StartTime
+	})
+
+	if query.Offset >= int64(len(contacts)) {
+		return []ContactEvent{}, nil
+	}
+	contacts = contacts[query.Offset:]
+	if query.Limit > 0 && int64(len(contacts)) > query.Limit {
+		contacts = contacts[:query.Limit]
+	}
+	return contacts, nil
+}
+
+// MinuteAggregates returns a copy of the stored minute aggregates
+func (s *MemoryStore) MinuteAggregates() []MinuteAggregate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]MinuteAggregate{}, s.minuteAggregates...)
+}
+
+func (s *MemoryStore) FindVenueEvents(venue string, bucketSize int64, timeBucket uint32) (events []PositionEvent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.events {
+		if e.Venue == venue && bucketSizeOf(e.BucketSize) == bucketSize && e.TimeBucket == timeBucket {
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return bytes.Compare(events[i].ID[:], events[j].ID[:]) < 0
+	})
+	return
+}
+
+func (s *MemoryStore) FindVenueContacts(venue string, bucketSize int64, from uint32, to uint32) (contacts []ContactEvent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, contact := range s.contacts {
+		if isVenueContact(contact, venue, bucketSize, from, to) {
+			contacts = append(contacts, contact)
+		}
+	}
+	return
+}
+
+func (s *MemoryStore) CountVenueRange(venue string, bucketSize int64, from uint32, to uint32) (counts RangeCounts, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.events {
+		if e.Venue == venue && bucketSizeOf(e.BucketSize) == bucketSize && e.TimeBucket >= from && e.TimeBucket <= to {
+			counts.PositionEvents++
+		}
+	}
+	for _, m := range s.minuteAggregates {
+		if isVenueMinuteAggregate(m, venue, bucketSize, from, to) {
+			counts.MinuteAggregates++
+		}
+	}
+	for _, contact := range s.contacts {
+		if isVenueContact(contact, venue, bucketSize, from, to) {
+			counts.ContactEvents++
+		}
+	}
+	return
+}
+
+func (s *MemoryStore) DeleteDerived(venue string, bucketSize int64, from uint32, to uint32) (deleted RangeCounts, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	merged := map[primitive.ObjectID]bool{}
+	contacts := s.contacts[:0]
+	for _, contact := range s.contacts {
+		if isVenueContact(contact, venue, bucketSize, from, to) {
+			for _, id := range contact.MinuteAggregates {
+				merged[id] = true
+			}
+			deleted.ContactEvents++
+			continue
+		}
+		contacts = append(contacts, contact)
+	}
+	s.contacts = contacts
+
+	var removed []MinuteAggregate
+	minAggregates := s.minuteAggregates[:0]
+	for _, m := range s.minuteAggregates {
+		if isVenueMinuteAggregate(m, venue, bucketSize, from, to) {
+			delete(s.aggregateKeys, fmt.Sprintf("%s/%s/%d", m.Events[0].DeviceID, m.Events[1].DeviceID, m.TimeBucket))
+			removed = append(removed, m)
+			deleted.MinuteAggregates++
+			continue
+		}
+		minAggregates = append(minAggregates, m)
+	}
+	s.minuteAggregates = minAggregates
+
+	s.subtractExposures(mergedExposures(removed, merged))
+	return
+}
+
+// subtractExposures takes exposures off the stored daily exposures of the
+// same devices and day, deleting the ones left without any minutes
+func (s *MemoryStore) subtractExposures(exposures []DailyExposure) {
+	for _, exposure := range exposures {
+		remaining := s.dailyExposures[:0]
+		for _, existing := range s.dailyExposures {
+			if existing.Devices == exposure.Devices && existing.Day == exposure.Day {
+				existing.Minutes -= exposure.Minutes
+				existing.ExposureMinutes -= exposure.ExposureMinutes
+				if existing.Minutes <= 0 {
+					continue
+				}
+			}
+			remaining = append(remaining, existing)
+		}
+		s.dailyExposures = remaining
+	}
+}
+
+func isVenueContact(contact ContactEvent, venue string, bucketSize int64, from uint32, to uint32) bool {
+	return contact.Venue == venue && bucketSizeOf(contact.BucketSize) == bucketSize && contact.End >= from && contact.Start <= to
+}
+
+func isVenueMinuteAggregate(m MinuteAggregate, venue string, bucketSize int64, from uint32, to uint32) bool {
+	return m.Venue == venue && bucketSizeOf(m.BucketSize) == bucketSize && m.TimeBucket >= from && m.TimeBucket <= to
+}
+
+func (s *MemoryStore) FindChanges(query ContactChangeQuery) (changes []ContactChange, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes = []ContactChange{}
+	for _, change := range s.contactChanges {
+		if change.Seq <= query.After || change.ChangedAt.Before(query.Since) {
+			continue
+		}
+		if query.Venue != "" && change.Venue != query.Venue {
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Seq < changes[j].Seq
+	})
+	if query.Limit > 0 && int64(len(changes)) > query.Limit {
+		changes = changes[:query.Limit]
+	}
+	return changes, nil
+}
@@ -0,0 +1,154 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/indexes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const concurrentAggregators = 8
+const concurrentMinutes = 60
+
+// mergeConcurrently merges a minute of contact between the same pair of
+// devices for every bucket from 100 using several AggregateWorkers that
+// share one channel, as if they ran in separate processes, in random order
+// and checks they end up as a single contact event and daily exposure
+func mergeConcurrently(t *testing.T, store Store) {
+	minAggregateChan := make(chan MinuteAggregate, concurrentMinutes)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentAggregators; i++ {
+		wg.Add(1)
+		go AggregateWorker(AggregateWorkerConfig{
+			Store:            store,
+			MinAggregateChan: minAggregateChan,
+			WG:               &wg,
+			Name:             i,
+		})
+	}
+
+	var minAggregates []MinuteAggregate
+	for minute := uint32(100); minute < 100+concurrentMinutes; minute++ {
+		minAggregate := MinuteAggregate{
+			TimeBucket:  minute,
+			Events:      [2]PartialPositionEvent{{DeviceID: "a"}, {DeviceID: "b"}},
+			Distance:    1,
+			Venue:       "venue",
+			Probability: 1,
+			Pending:     true,
+		}
+		id, err := store.InsertMinuteAggregate(minAggregate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		minAggregate.ID = id
+		minAggregates = append(minAggregates, minAggregate)
+	}
+
+	rand.Shuffle(len(minAggregates), func(i, j int) {
+		minAggregates[i], minAggregates[j] = minAggregates[j], minAggregates[i]
+	})
+	for _, minAggregate := range minAggregates {
+		minAggregateChan <- minAggregate
+	}
+	close(minAggregateChan)
+	wg.Wait()
+
+	contacts, err := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 {
+		t.Fatalf("expected 1 contact but got %d: %v", len(contacts), contacts)
+	}
+	if contacts[0].Start != 100 || contacts[0].End != 100+concurrentMinutes-1 || contacts[0].Duration != concurrentMinutes {
+		t.Errorf("expected contact from 100 lasting %d but got %v", concurrentMinutes, contacts[0])
+	}
+	if len(contacts[0].MinuteAggregates) != concurrentMinutes {
+		t.Errorf("expected %d minute aggregates but got %d", concurrentMinutes, len(contacts[0].MinuteAggregates))
+	}
+
+	// minute 100 is long closed so every merge that joined a contact
+	// recorded a change, each numbered once without gaps
+	changes, err := store.FindChanges(ContactChangeQuery{Limit: concurrentMinutes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, change := range changes {
+		if change.Seq != int64(i+1) {
+			t.Fatalf("expected change %d to have seq %d but got %d", i, i+1, change.Seq)
+		}
+	}
+
+	exposures, err := store.FindDaily(DailyExposureQuery{Device: "a", From: 0, To: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exposures) != 1 || exposures[0].Minutes != concurrentMinutes {
+		t.Errorf("expected 1 daily exposure of %d minutes but got %v", concurrentMinutes, exposures)
+	}
+}
+
+// TestConcurrentMergesOfSamePair only checks the merging itself, as the
+// MemoryStore serializes merges with a single mutex. The contact-lock
+// transactions that serialize merges across processes are only covered by
+// TestConcurrentMergesOfSamePairMongo.
+func TestConcurrentMergesOfSamePair(t *testing.T) {
+	mergeConcurrently(t, NewMemoryStore())
+}
+
+// TestConcurrentMergesOfSamePairMongo runs against the replica set at
+// MONGO_TEST_URL in a database that is dropped afterwards. CI runs it
+// against a single node replica set; locally start one with
+//
+//	docker run -d -p 27017:27017 mongo:4.4 --replSet rs0
+//	docker exec <container> mongo --eval 'rs.initiate()'
+//
+// and run make test-mongo.
+func TestConcurrentMergesOfSamePairMongo(t *testing.T) {
+	url := os.Getenv("MONGO_TEST_URL")
+	if url == "" {
+		t.Skip("set MONGO_TEST_URL to a replica set to run against mongo")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database(fmt.Sprintf("merge-test-%d", time.Now().UnixNano()))
+	defer db.Drop(ctx)
+
+	// creating the indexes also creates the collections, which
+	// transactions can't do before mongo 4.4
+	if err := indexes.Ensure(ctx, db, indexes.Required); err != nil {
+		t.Fatal(err)
+	}
+
+	mergeConcurrently(t, NewMongoStore(db))
+
+	// the lock expires with the last minute merged under it
+	var lock struct {
+		End   uint32 `bson:"end"`
+		Venue string `bson:"venue"`
+	}
+	if err := db.Collection("contact-lock").FindOne(ctx, bson.M{"devices": [2]string{"a", "b"}}).Decode(&lock); err != nil {
+		t.Fatal(err)
+	}
+	if lock.End < 100 || lock.End >= 100+concurrentMinutes || lock.Venue != "venue" {
+		t.Errorf("expected the lock to record a minute merged at venue but got %+v", lock)
+	}
+}
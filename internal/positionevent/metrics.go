@@ -0,0 +1,115 @@
+package positionevent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "contact_monitoring"
+
+var (
+	positionEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "position_events_total",
+		Help:      "Position events received by PostHandler by result.",
+	}, []string{"result"})
+
+	positionEventsInterpolated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "position_events_interpolated_total",
+		Help:      "Position events interpolated between the sparse positions of a device by result.",
+	}, []string{"result"})
+
+	positionEventLateness = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "position_event_lateness_seconds",
+		Help:      "How far behind the server the time of position events received by PostHandler is.",
+		Buckets:   []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 7 * 24 * 3600},
+	})
+
+	nearbyQueryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "nearby_query_duration_seconds",
+		Help:      "Latency of the EventWorker nearby position event query.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+
+	nearbyQueryErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "nearby_query_errors_total",
+		Help:      "EventWorker nearby position event queries that failed.",
+	})
+
+	nearbyMatches = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "nearby_matches",
+		Help:      "Position events within contact distance per processed event.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100},
+	})
+
+	nearbySeparated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "nearby_separated_total",
+		Help:      "Position events within contact distance that a wall or room of the floor plan kept apart.",
+	})
+
+	minuteAggregatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "minute_aggregates_total",
+		Help:      "Minute aggregate inserts by result.",
+	}, []string{"result"})
+
+	minuteAggregatesDeferred = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "minute_aggregates_deferred_total",
+		Help:      "Minute aggregates left pending because the broker didn't accept them in time.",
+	})
+
+	zoneOccupancyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "zone_occupancy_total",
+		Help:      "Position events recorded in the occupancy of their zone by result.",
+	}, []string{"result"})
+
+	contactMergesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "contact_merges_total",
+		Help:      "AggregateWorker contact event merges by result.",
+	}, []string{"result"})
+)
+
+// position event results
+const (
+	resultAccepted      = "accepted"
+	resultVenueMismatch = "venue_mismatch"
+	resultAccuracy      = "accuracy"
+	resultDuplicate     = "duplicate"
+	resultCombined      = "combined"
+	resultReplaced      = "replaced"
+	resultConsent       = "consent"
+	resultQueueFull     = "queue_full"
+	resultThrottled     = "throttled"
+	resultFuture        = "future"
+	resultLate          = "late"
+	resultError         = "error"
+)
+
+// minute aggregate, contact merge and zone occupancy results
+const (
+	resultInserted = "inserted"
+	resultMerged   = "merged"
+	resultRecorded = "recorded"
+)
+
+// RegisterQueueDepth exposes the number of items waiting in queue as the
+// queue_depth gauge labeled with name
+func RegisterQueueDepth(name string, queue func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "queue_depth",
+		Help:        "Items waiting in an in-process pipeline queue.",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 {
+		return float64(queue())
+	})
+}
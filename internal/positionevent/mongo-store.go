@@ -0,0 +1,742 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/pkg/geo"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+type mongoStore struct {
+	ContactRepo
+	ExposureRepo
+	ChangeRepo
+	OccupancyRepo
+	client             *mongo.Client
+	eventCol           *mongo.Collection
+	minuteAggregateCol *mongo.Collection
+	contactEventCol    *mongo.Collection
+	dailyExposureCol   *mongo.Collection
+	contactLockCol     *mongo.Collection
+	contactChangeCol   *mongo.Collection
+	counterCol         *mongo.Collection
+	zoneOccupancyCol   *mongo.Collection
+	leaseCol           *mongo.Collection
+}
+
+// NewMongoStore returns a Store backed by the position-event,
+// minute-aggregation, contact-event, daily-exposure, contact-change,
+// counter, zone-occupancy and lease collections of db.
+// Contact events are merged in transactions so db has to be served by a
+// replica set, which can be a single node.
+func NewMongoStore(db *mongo.Database) Store {
+	contactEventCol := db.Collection("contact-event")
+	dailyExposureCol := db.Collection("daily-exposure")
+	contactChangeCol := db.Collection("contact-change")
+	zoneOccupancyCol := db.Collection("zone-occupancy")
+	return &mongoStore{
+		ContactRepo:        NewContactRepo(contactEventCol),
+		ExposureRepo:       NewExposureRepo(dailyExposureCol),
+		ChangeRepo:         NewChangeRepo(contactChangeCol),
+		OccupancyRepo:      NewOccupancyRepo(zoneOccupancyCol),
+		client:             db.Client(),
+		eventCol:           db.Collection("position-event"),
+		minuteAggregateCol: db.Collection("minute-aggregation"),
+		contactEventCol:    contactEventCol,
+		dailyExposureCol:   dailyExposureCol,
+		contactLockCol:     db.Collection("contact-lock"),
+		contactChangeCol:   contactChangeCol,
+		counterCol:         db.Collection("counter"),
+		zoneOccupancyCol:   zoneOccupancyCol,
+		leaseCol:           db.Collection("lease"),
+	}
+}
+
+// isDuplicateKeyError reports whether err is a single duplicate key error
+// which callers treat as an expected outcome rather than a failure
+func isDuplicateKeyError(err error) bool {
+	if merr, ok := err.(mongo.WriteException); ok {
+		return len(merr.WriteErrors) == 1 && merr.WriteErrors[0].Code == 11000
+	}
+	// find and modify commands report it as a command error
+	if cerr, ok := err.(mongo.CommandError); ok {
+		return cerr.Code == 11000
+	}
+	return false
+}
+
+func (s *mongoStore) InsertEvent(event PositionEvent) (id primitive.ObjectID, err error) {
+	res, err := s.eventCol.InsertOne(context.Background(), event)
+	if err != nil {
+		if isDuplicateKeyError(err) {
+			err = ErrDuplicate
+		}
+		return
+	}
+
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func (s *mongoStore) UpsertEvent(event PositionEvent) (id primitive.ObjectID, replaced bool, err error) {
+	filter := bson.M{
+		"device":     event.DeviceID,
+		"timeBucket": event.TimeBucket,
+		"$or": bson.A{
+			bson.M{"quality": bson.M{"$lt": event.Quality}},
+			bson.M{"quality": bson.M{"$exists": false}},
+			bson.M{"interpolated": true},
+		},
+	}
+
+	// a stored event that doesn't match the filter makes the upsert
+	// collide with it on the unique device and time bucket index
+	var stored struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = s.eventCol.FindOneAndReplace(
+		context.Background(),
+		filter,
+		event,
+		options.FindOneAndReplace().
+			SetUpsert(true).
+			SetReturnDocument(options.Before).
+			SetProjection(bson.M{"_id": 1}),
+	).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		err = s.eventCol.FindOne(
+			context.Background(),
+			bson.M{"device": event.DeviceID, "timeBucket": event.TimeBucket},
+			options.FindOne().SetProjection(bson.M{"_id": 1}),
+		).Decode(&stored)
+		return stored.ID, false, err
+	}
+	if err != nil {
+		if isDuplicateKeyError(err) {
+			err = ErrDuplicate
+		}
+		return
+	}
+	return stored.ID, true, nil
+}
+
+func (s *mongoStore) ReplaceInterpolatedEvent(event PositionEvent) (id primitive.ObjectID, err error) {
+	var stored struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = s.eventCol.FindOneAndReplace(
+		context.Background(),
+		bson.M{"device": event.DeviceID, "timeBucket": event.TimeBucket, "interpolated": true},
+		event,
+		options.FindOneAndReplace().SetProjection(bson.M{"_id": 1}),
+	).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return id, ErrDuplicate
+	}
+	return stored.ID, err
+}
+
+func (s *mongoStore) DeleteEvent(id primitive.ObjectID) (err error) {
+	_, err = s.eventCol.DeleteOne(context.Background(), bson.M{"_id": id})
+	return
+}
+
+// DeleteEventDerived finds the contact events to delete by the devices
+// of the minute aggregates derived from event, so it only reads through
+// the indexes on devices. It takes the contact lock of every pair of
+// devices in the same transaction, so an AggregateWorker merging one of
+// the minute aggregates either commits before it, or finds the minute
+// aggregate gone and merges nothing.
+func (s *mongoStore) DeleteEventDerived(event PositionEvent) (remerge []MinuteAggregate, err error) {
+	ctx := context.Background()
+	session, err := s.client.StartSession()
+	if err != nil {
+		return
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		var err error
+		remerge, err = s.deleteEventDerived(sc, event)
+		return nil, err
+	}, options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *mongoStore) deleteEventDerived(ctx mongo.SessionContext, event PositionEvent) (remerge []MinuteAggregate, err error) {
+	cursor, err := s.minuteAggregateCol.Find(ctx, bson.M{
+		"events.device": event.DeviceID,
+		"timeBucket":    event.TimeBucket,
+		"events._id":    event.ID,
+	})
+	if err != nil {
+		return
+	}
+	var derived []MinuteAggregate
+	if err = cursor.All(ctx, &derived); err != nil || len(derived) == 0 {
+		return
+	}
+
+	var derivedIDs []primitive.ObjectID
+	var contactFilters bson.A
+	for _, m := range derived {
+		devices := [2]string{m.Events[0].DeviceID, m.Events[1].DeviceID}
+		// a lock created here expires with the minute aggregate
+		_, err = s.contactLockCol.UpdateOne(
+			ctx,
+			bson.M{"devices": devices},
+			bson.M{
+				"$inc": bson.M{"version": 1},
+				"$setOnInsert": bson.M{
+					"end":        m.TimeBucket,
+					"bucketSize": bucketSizeOf(m.BucketSize),
+					"venue":      m.Venue,
+				},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return
+		}
+		derivedIDs = append(derivedIDs, m.ID)
+		contactFilters = append(contactFilters, bson.M{
+			"devices":          devices,
+			"minuteaggregates": m.ID,
+		})
+	}
+	cursor, err = s.contactEventCol.Find(ctx, bson.M{"$or": contactFilters})
+	if err != nil {
+		return
+	}
+	var contacts []ContactEvent
+	if err = cursor.All(ctx, &contacts); err != nil {
+		return
+	}
+
+	merged := map[primitive.ObjectID]bool{}
+	var contactIDs, mergedIDs []primitive.ObjectID
+	for _, contact := range contacts {
+		contactIDs = append(contactIDs, contact.ID)
+		for _, id := range contact.MinuteAggregates {
+			merged[id] = true
+			mergedIDs = append(mergedIDs, id)
+		}
+	}
+
+	var minAggregates []MinuteAggregate
+	if len(mergedIDs) > 0 {
+		cursor, err = s.minuteAggregateCol.Find(ctx, bson.M{"_id": bson.M{"$in": mergedIDs}})
+		if err != nil {
+			return
+		}
+		if err = cursor.All(ctx, &minAggregates); err != nil {
+			return
+		}
+	}
+
+	// the other minute aggregates are left pending so they are merged
+	// again, at the latest by Redeliver
+	isDerived := map[primitive.ObjectID]bool{}
+	for _, id := range derivedIDs {
+		isDerived[id] = true
+	}
+	var remergeIDs []primitive.ObjectID
+	for _, m := range minAggregates {
+		if !isDerived[m.ID] {
+			m.Pending = true
+			remerge = append(remerge, m)
+			remergeIDs = append(remergeIDs, m.ID)
+		}
+	}
+	if len(remergeIDs) > 0 {
+		_, err = s.minuteAggregateCol.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": remergeIDs}}, bson.M{"$set": bson.M{"pending": true}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = s.subtractExposures(ctx, mergedExposures(minAggregates, merged)); err != nil {
+		return nil, err
+	}
+	if len(contactIDs) > 0 {
+		if _, err = s.contactEventCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": contactIDs}}); err != nil {
+			return nil, err
+		}
+	}
+	_, err = s.minuteAggregateCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": derivedIDs}})
+	if err != nil {
+		return nil, err
+	}
+	return remerge, nil
+}
+
+// FindNearby returns the other events on floors and in the same time
+// bucket of the same size as event that are within radius meters of it
+func (s *mongoStore) FindNearby(event PositionEvent, floors []int16, radius float64) (events []PositionEvent, err error) {
+	query := bson.M{
+		"_id": bson.M{
+			"$ne": event.ID,
+		},
+		"floor": bson.M{
+			"$in": floors,
+		},
+		"lonlat": bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": bson.A{
+					event.LonLat,
+					radius / geo.EarthRadiusMeters,
+				},
+			},
+		},
+		"timeBucket": event.TimeBucket,
+		"bucketSize": bucketSizeFilter(event.BucketSize),
+	}
+	cursor, err := s.eventCol.Find(context.Background(), query)
+	if err != nil {
+		return
+	}
+
+	err = cursor.All(context.Background(), &events)
+	return
+}
+
+func (s *mongoStore) LastEvent(device string, bucketSize int64, before uint32) (event *PositionEvent, err error) {
+	err = s.eventCol.FindOne(
+		context.Background(),
+		bson.M{
+			"device":     device,
+			"bucketSize": bucketSizeFilter(bucketSize),
+			"timeBucket": bson.M{"$lt": before},
+		},
+		options.FindOne().SetSort(bson.M{"timeBucket": -1}),
+	).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return
+}
+
+func (s *mongoStore) AckEvent(id primitive.ObjectID) (err error) {
+	_, err = s.eventCol.UpdateOne(
+		context.Background(),
+		bson.M{"_id": id},
+		bson.M{"$unset": bson.M{"pending": ""}},
+	)
+	return
+}
+
+// PendingEvents returns up to limit unacknowledged events with an _id
+// between after and before, sorted by _id
+func (s *mongoStore) PendingEvents(after primitive.ObjectID, before primitive.ObjectID, limit int64) (events []PositionEvent, err error) {
+	cursor, err := s.eventCol.Find(
+		context.Background(),
+		pendingFilter(after, before),
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit),
+	)
+	if err != nil {
+		return
+	}
+
+	err = cursor.All(context.Background(), &events)
+	return
+}
+
+func (s *mongoStore) InsertMinuteAggregate(minAggregate MinuteAggregate) (id primitive.ObjectID, err error) {
+	res, err := s.minuteAggregateCol.InsertOne(context.Background(), minAggregate)
+	if err != nil {
+		if isDuplicateKeyError(err) {
+			err = ErrDuplicate
+		}
+		return
+	}
+
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func (s *mongoStore) AckMinuteAggregate(id primitive.ObjectID) (err error) {
+	_, err = s.minuteAggregateCol.UpdateOne(
+		context.Background(),
+		bson.M{"_id": id},
+		bson.M{"$unset": bson.M{"pending": ""}},
+	)
+	return
+}
+
+// PendingMinuteAggregates returns up to limit unacknowledged minute
+// aggregates with an _id between after and before, sorted by _id
+func (s *mongoStore) PendingMinuteAggregates(after primitive.ObjectID, before primitive.ObjectID, limit int64) (minAggregates []MinuteAggregate, err error) {
+	cursor, err := s.minuteAggregateCol.Find(
+		context.Background(),
+		pendingFilter(after, before),
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit),
+	)
+	if err != nil {
+		return
+	}
+
+	err = cursor.All(context.Background(), &minAggregates)
+	return
+}
+
+func pendingFilter(after primitive.ObjectID, before primitive.ObjectID) bson.M {
+	return bson.M{
+		"pending": true,
+		"_id": bson.M{
+			"$gt": after,
+			"$lt": before,
+		},
+	}
+}
+
+// MergeContact replaces the contact events of the same devices that end
+// or start within maxGap time buckets of contact with a single merged
+// contact event and returns it. If a contact event already contains the
+// minute aggregate of contact it is returned unchanged, so replaying a
+// minute aggregate never counts it twice.
+//
+// The merge runs in a transaction which starts by writing the lock
+// document of the devices, so concurrent merges for the same devices,
+// from this or any other process, conflict and are retried one after
+// the other instead of reading the same neighbours.
+func (s *mongoStore) MergeContact(contact ContactEvent, maxGap uint32, closedBefore uint32) (merged ContactEvent, err error) {
+	ctx := context.Background()
+	session, err := s.client.StartSession()
+	if err != nil {
+		return
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		var err error
+		merged, err = s.mergeContact(sc, contact, maxGap, closedBefore)
+		return nil, err
+	}, options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority())),
+	)
+	return
+}
+
+func (s *mongoStore) mergeContact(ctx mongo.SessionContext, contact ContactEvent, maxGap uint32, closedBefore uint32) (merged ContactEvent, err error) {
+	// the lock records the last minute merged and its venue so it
+	// expires with the contact events of the devices
+	_, err = s.contactLockCol.UpdateOne(
+		ctx,
+		bson.M{"devices": contact.Devices},
+		bson.M{
+			"$inc": bson.M{"version": 1},
+			"$set": bson.M{
+				"end":        contact.End,
+				"bucketSize": bucketSizeOf(contact.BucketSize),
+				"venue":      contact.Venue,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return
+	}
+
+	// the minute aggregate is gone when the event it was derived from
+	// was replaced since, see DeleteEventDerived
+	count, err := s.minuteAggregateCol.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": contact.MinuteAggregates}})
+	if err != nil || count == 0 {
+		return
+	}
+
+	err = s.contactEventCol.FindOne(
+		ctx,
+		bson.M{
+			"devices":          contact.Devices,
+			"minuteaggregates": bson.M{"$all": contact.MinuteAggregates},
+		},
+	).Decode(&merged)
+	if err == nil {
+		return merged, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return merged, err
+	}
+
+	from, to := mergeWindow(contact, maxGap)
+	cursor, err := s.contactEventCol.Find(ctx, bson.M{
+		"devices":    contact.Devices,
+		"bucketSize": bucketSizeFilter(contact.BucketSize),
+		"end":        bson.M{"$gte": from},
+		"start":      bson.M{"$lte": to},
+	})
+	if err != nil {
+		return
+	}
+	var neighbours []ContactEvent
+	if err = cursor.All(ctx, &neighbours); err != nil {
+		return
+	}
+
+	var operations []mongo.WriteModel
+	for _, neighbour := range neighbours {
+		operation := mongo.NewDeleteOneModel()
+		operation.SetFilter(bson.M{"_id": neighbour.ID})
+		operations = append(operations, operation)
+	}
+
+	merged = mergeContacts(contact, neighbours)
+
+	// insert the merged contact event
+	operation := mongo.NewInsertOneModel()
+	operation.SetDocument(merged)
+	operations = append(operations, operation)
+
+	_, err = s.contactEventCol.BulkWrite(ctx, operations, &options.BulkWriteOptions{})
+	if err != nil {
+		return
+	}
+
+	if change, changed := newContactChange(contact, neighbours, merged, closedBefore); changed {
+		if change.Seq, err = s.nextSeq(ctx, "contact-change"); err != nil {
+			return
+		}
+		if _, err = s.contactChangeCol.InsertOne(ctx, change); err != nil {
+			return
+		}
+	}
+
+	err = s.addDailyExposure(ctx, contact)
+	return
+}
+
+// nextSeq increments the named counter and returns its new value. Called
+// in a transaction, concurrent transactions conflict on the counter and
+// are retried one after the other, so values are taken in commit order.
+func (s *mongoStore) nextSeq(ctx context.Context, name string) (seq int64, err error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err = s.counterCol.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Seq, err
+}
+
+// addDailyExposure adds a contact event of a single minute
+// aggregate to the DailyExposure of its devices
+func (s *mongoStore) addDailyExposure(ctx context.Context, contact ContactEvent) (err error) {
+	day := dayOf(contact.Start, contact.BucketSize)
+	update := bson.M{
+		"$inc": bson.M{
+			"minutes":         contact.Duration,
+			"exposureMinutes": contact.ExposureMinutes,
+		},
+		"$setOnInsert": bson.M{"start": day * bucketsPerDay},
+	}
+	if contact.Venue != "" {
+		update["$addToSet"] = bson.M{"venues": contact.Venue}
+	}
+
+	_, err = s.dailyExposureCol.UpdateOne(
+		ctx,
+		bson.M{"devices": contact.Devices, "day": day},
+		update,
+		options.Update().SetUpsert(true),
+	)
+	return
+}
+
+func (s *mongoStore) RecordOccupancy(event PositionEvent) (err error) {
+	bucketSize := bucketSizeOf(event.BucketSize)
+	_, err = s.zoneOccupancyCol.UpdateMany(
+		context.Background(),
+		bson.M{
+			"venue":      event.Venue,
+			"bucketSize": bucketSize,
+			"timeBucket": event.TimeBucket,
+			"zone":       bson.M{"$ne": event.Zone},
+			"devices":    event.DeviceID,
+		},
+		bson.M{"$pull": bson.M{"devices": event.DeviceID}},
+	)
+	if err != nil || event.Zone == "" {
+		return
+	}
+
+	filter := bson.M{
+		"venue":      event.Venue,
+		"bucketSize": bucketSize,
+		"timeBucket": event.TimeBucket,
+		"zone":       event.Zone,
+	}
+	update := bson.M{
+		"$addToSet":    bson.M{"devices": event.DeviceID},
+		"$setOnInsert": bson.M{"floor": event.Floor},
+	}
+	_, err = s.zoneOccupancyCol.UpdateOne(context.Background(), filter, update, options.Update().SetUpsert(true))
+	if isDuplicateKeyError(err) {
+		// another event of the zone and time bucket upserted it first
+		_, err = s.zoneOccupancyCol.UpdateOne(context.Background(), filter, update)
+	}
+	return
+}
+
+// AcquireLease upserts the lease document when holder has it or it has
+// expired. When another holder has it the filter doesn't match and the
+// upsert collides with the existing document on _id.
+func (s *mongoStore) AcquireLease(name string, holder string, ttl time.Duration) (acquired bool, err error) {
+	now := time.Now()
+	_, err = s.leaseCol.UpdateOne(
+		context.Background(),
+		bson.M{
+			"_id": name,
+			"$or": bson.A{
+				bson.M{"holder": holder},
+				bson.M{"expires": bson.M{"$lte": now}},
+			},
+		},
+		bson.M{"$set": bson.M{"holder": holder, "expires": now.Add(ttl)}},
+		options.Update().SetUpsert(true),
+	)
+	if isDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FindVenueEvents returns the events of venue in timeBucket of
+// bucketSize sorted by _id
+func (s *mongoStore) FindVenueEvents(venue string, bucketSize int64, timeBucket uint32) (events []PositionEvent, err error) {
+	cursor, err := s.eventCol.Find(
+		context.Background(),
+		bson.M{"timeBucket": timeBucket, "venue": venue, "bucketSize": bucketSizeFilter(bucketSize)},
+		options.Find().SetSort(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return
+	}
+
+	err = cursor.All(context.Background(), &events)
+	return
+}
+
+func venueContactFilter(venue string, bucketSize int64, from uint32, to uint32) bson.M {
+	return bson.M{
+		"venue":      venue,
+		"bucketSize": bucketSizeFilter(bucketSize),
+		"end":        bson.M{"$gte": from},
+		"start":      bson.M{"$lte": to},
+	}
+}
+
+func venueRangeFilter(venue string, bucketSize int64, from uint32, to uint32) bson.M {
+	return bson.M{
+		"venue":      venue,
+		"bucketSize": bucketSizeFilter(bucketSize),
+		"timeBucket": bson.M{"$gte": from, "$lte": to},
+	}
+}
+
+// FindVenueContacts returns the contact events of venue overlapping
+// the time buckets of bucketSize from to to
+func (s *mongoStore) FindVenueContacts(venue string, bucketSize int64, from uint32, to uint32) (contacts []ContactEvent, err error) {
+	cursor, err := s.contactEventCol.Find(context.Background(), venueContactFilter(venue, bucketSize, from, to))
+	if err != nil {
+		return
+	}
+
+	err = cursor.All(context.Background(), &contacts)
+	return
+}
+
+func (s *mongoStore) CountVenueRange(venue string, bucketSize int64, from uint32, to uint32) (counts RangeCounts, err error) {
+	ctx := context.Background()
+	counts.PositionEvents, err = s.eventCol.CountDocuments(ctx, venueRangeFilter(venue, bucketSize, from, to))
+	if err != nil {
+		return
+	}
+	counts.MinuteAggregates, err = s.minuteAggregateCol.CountDocuments(ctx, venueRangeFilter(venue, bucketSize, from, to))
+	if err != nil {
+		return
+	}
+	counts.ContactEvents, err = s.contactEventCol.CountDocuments(ctx, venueContactFilter(venue, bucketSize, from, to))
+	return
+}
+
+// DeleteDerived deletes the minute aggregates of venue in the time buckets
+// of bucketSize from to to and its contact events overlapping them. The minute
+// aggregates that were merged into contact events are taken off the daily
+// exposures of their devices, deleting the ones left without any minutes.
+func (s *mongoStore) DeleteDerived(venue string, bucketSize int64, from uint32, to uint32) (deleted RangeCounts, err error) {
+	ctx := context.Background()
+
+	contacts, err := s.FindVenueContacts(venue, bucketSize, from, to)
+	if err != nil {
+		return
+	}
+	merged := map[primitive.ObjectID]bool{}
+	for _, contact := range contacts {
+		for _, id := range contact.MinuteAggregates {
+			merged[id] = true
+		}
+	}
+
+	cursor, err := s.minuteAggregateCol.Find(ctx, venueRangeFilter(venue, bucketSize, from, to))
+	if err != nil {
+		return
+	}
+	var minAggregates []MinuteAggregate
+	if err = cursor.All(ctx, &minAggregates); err != nil {
+		return
+	}
+
+	if err = s.subtractExposures(ctx, mergedExposures(minAggregates, merged)); err != nil {
+		return
+	}
+
+	res, err := s.contactEventCol.DeleteMany(ctx, venueContactFilter(venue, bucketSize, from, to))
+	if err != nil {
+		return
+	}
+	deleted.ContactEvents = res.DeletedCount
+
+	res, err = s.minuteAggregateCol.DeleteMany(ctx, venueRangeFilter(venue, bucketSize, from, to))
+	if err != nil {
+		return
+	}
+	deleted.MinuteAggregates = res.DeletedCount
+	return
+}
+
+// subtractExposures takes exposures off the stored daily exposures of the
+// same devices and day, deleting the ones left without any minutes
+func (s *mongoStore) subtractExposures(ctx context.Context, exposures []DailyExposure) (err error) {
+	var operations []mongo.WriteModel
+	for _, exposure := range exposures {
+		filter := bson.M{"devices": exposure.Devices, "day": exposure.Day}
+		operations = append(operations,
+			mongo.NewUpdateOneModel().
+				SetFilter(filter).
+				SetUpdate(bson.M{"$inc": bson.M{
+					"minutes":         -exposure.Minutes,
+					"exposureMinutes": -exposure.ExposureMinutes,
+				}}),
+			mongo.NewDeleteOneModel().
+				SetFilter(bson.M{"devices": exposure.Devices, "day": exposure.Day, "minutes": bson.M{"$lte": 0}}),
+		)
+	}
+	if len(operations) > 0 {
+		_, err = s.dailyExposureCol.BulkWrite(ctx, operations)
+	}
+	return
+}
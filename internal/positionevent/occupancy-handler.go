@@ -0,0 +1,94 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultAlertThreshold = 1.0
+
+// maxOccupancyRange is the longest range of time the occupancy of a venue
+// can be read for at once
+const maxOccupancyRange = 7 * 24 * time.Hour
+
+type occupancyQueryParams struct {
+	From      *int64  `form:"from" binding:"required"`
+	To        int64   `form:"to"`
+	Zone      string  `form:"zone"`
+	Threshold float64 `form:"threshold"`
+}
+
+// GetOccupancyHandler returns a gin HandlerFunc which reports how many
+// devices were in each zone of the venue path param per time bucket, how
+// long they stayed and when the occupancy of a zone reached threshold
+// times its capacity. from and to are epoch milliseconds like
+// PositionEvent.Time; to defaults to now and threshold to 1. The time
+// buckets are of the size the venue is configured with.
+func GetOccupancyHandler(occupancyRepo OccupancyRepo, venues venue.Configs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params occupancyQueryParams
+		if err := c.ShouldBindQuery(&params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if params.To == 0 {
+			params.To = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		from := *params.From
+		if params.To < from {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+			return
+		}
+		if params.To-from > maxOccupancyRange.Milliseconds() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("from and to must not be more than %v apart", maxOccupancyRange)})
+			return
+		}
+		if params.Threshold < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold must not be negative"})
+			return
+		}
+		if params.Threshold == 0 {
+			params.Threshold = defaultAlertThreshold
+		}
+
+		venueName := c.Param("venue")
+		config := venues.For(venueName)
+		bucketSize := bucketSizeOf(config.TimeBucketSize)
+		fromBucket, toBucket := uint32(from/bucketSize), uint32(params.To/bucketSize)
+		occupancies, err := occupancyRepo.FindOccupancy(OccupancyQuery{
+			Venue:      venueName,
+			Zone:       params.Zone,
+			BucketSize: bucketSize,
+			From:       fromBucket,
+			To:         toBucket,
+		})
+		if err != nil {
+			log.Println("error finding zone occupancy", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to find zone occupancy"})
+			return
+		}
+
+		var zones []venue.Zone
+		if config.Floors != nil {
+			for _, zone := range config.Floors.Zones {
+				if params.Zone == "" || zone.Name == params.Zone {
+					zones = append(zones, zone)
+				}
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"venue":      venueName,
+			"bucketSize": bucketSize,
+			"from":       fromBucket,
+			"to":         toBucket,
+			"zones":      buildZoneReports(zones, occupancies, bucketSize, params.Threshold),
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ZoneOccupancy is the devices that were in a zone of a venue during a
+// time bucket of BucketSize milliseconds. Devices are kept rather than
+// counted so recording the same position event again is a no-op, and so
+// the visits of each device can be followed for dwell times.
+type ZoneOccupancy struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Venue      string             `bson:"venue" json:"venue"`
+	Zone       string             `bson:"zone" json:"zone"`
+	Floor      int16              `bson:"floor" json:"floor"`
+	TimeBucket uint32             `bson:"timeBucket" json:"timeBucket"`
+	BucketSize int64              `bson:"bucketSize" json:"bucketSize"`
+	Devices    []string           `bson:"devices" json:"-"`
+}
+
+// OccupancyQuery describes a filter over the zone occupancies of a venue.
+// From and To are time buckets of BucketSize and Zone is ignored when
+// empty.
+type OccupancyQuery struct {
+	Venue      string
+	Zone       string
+	BucketSize int64
+	From       uint32
+	To         uint32
+}
+
+// OccupancyRepo is an interface for reading zone occupancies
+// from their persistence layer
+type OccupancyRepo interface {
+	FindOccupancy(query OccupancyQuery) (occupancies []ZoneOccupancy, err error)
+}
+
+type occupancyRepo struct {
+	col *mongo.Collection
+}
+
+// NewOccupancyRepo returns a new OccupancyRepo interface
+func NewOccupancyRepo(col *mongo.Collection) OccupancyRepo {
+	return &occupancyRepo{
+		col,
+	}
+}
+
+// FindOccupancy returns the zone occupancies matching query, sorted by
+// zone then time bucket
+func (r *occupancyRepo) FindOccupancy(query OccupancyQuery) (occupancies []ZoneOccupancy, err error) {
+	filter := bson.M{
+		"venue":      query.Venue,
+		"bucketSize": query.BucketSize,
+		"timeBucket": bson.M{
+			"$gte": query.From,
+			"$lte": query.To,
+		},
+	}
+	if query.Zone != "" {
+		filter["zone"] = query.Zone
+	}
+
+	cursor, err := r.col.Find(
+		context.Background(),
+		filter,
+		options.Find().SetSort(bson.D{{Key: "zone", Value: 1}, {Key: "timeBucket", Value: 1}}),
+	)
+	if err != nil {
+		return
+	}
+
+	occupancies = []ZoneOccupancy{}
+	err = cursor.All(context.Background(), &occupancies)
+	return
+}
+
+// zoneOf returns the name of the zone of config that event is in, or an
+// empty string when it is in none
+func zoneOf(config venue.Config, event PositionEvent) string {
+	if zone := config.Floors.ZoneAt(event.Floor, event.LonLat); zone != nil {
+		return zone.Name
+	}
+	return ""
+}
+
+// recordOccupancy records the device of event as in its zone for its time
+// bucket, and as no longer in any other zone of the venue in that time
+// bucket, in case event replaced an event of the device in another zone.
+// Events of venues without zones aren't recorded.
+func recordOccupancy(store Store, config venue.Config, event PositionEvent) error {
+	if !config.Floors.HasZones() {
+		return nil
+	}
+
+	if err := store.RecordOccupancy(event); err != nil {
+		zoneOccupancyTotal.WithLabelValues(resultError).Inc()
+		log.Println("error recording zone occupancy", err)
+		return err
+	}
+	zoneOccupancyTotal.WithLabelValues(resultRecorded).Inc()
+	return nil
+}
+
+// OccupancyBucket is how many devices were in a zone during a time bucket
+type OccupancyBucket struct {
+	TimeBucket uint32 `json:"timeBucket"`
+	Devices    int    `json:"devices"`
+}
+
+// CapacityAlert is a run of consecutive time buckets, from Start to End,
+// during which the occupancy of a zone reached its alert threshold
+type CapacityAlert struct {
+	Start       uint32 `json:"start"`
+	End         uint32 `json:"end"`
+	PeakDevices int    `json:"peakDevices"`
+}
+
+// ZoneReport summarizes the occupancy of a zone over a range of time
+// buckets. A visit is a run of consecutive time buckets a device was in
+// the zone for, and its dwell time the minutes of those time buckets.
+type ZoneReport struct {
+	Zone     string `json:"zone"`
+	Floor    int16  `json:"floor"`
+	Capacity int    `json:"capacity,omitempty"`
+	// Threshold is the occupancy at which an alert is raised, or zero
+	// when the zone has no capacity
+	Threshold        float64           `json:"threshold,omitempty"`
+	Buckets          []OccupancyBucket `json:"buckets"`
+	PeakDevices      int               `json:"peakDevices"`
+	Visitors         int               `json:"visitors"`
+	Visits           int               `json:"visits"`
+	MeanDwellMinutes float64           `json:"meanDwellMinutes"`
+	MaxDwellMinutes  float64           `json:"maxDwellMinutes"`
+	Alerts           []CapacityAlert   `json:"alerts"`
+}
+
+// buildZoneReports summarizes occupancies, sorted by zone then time
+// bucket, into a report per zone of zones followed by a report per zone
+// that has occupancies but is no longer defined. Alerts are raised when
+// the occupancy of a zone reaches threshold times its capacity.
+func buildZoneReports(zones []venue.Zone, occupancies []ZoneOccupancy, bucketSize int64, threshold float64) []ZoneReport {
+	byZone := map[string][]ZoneOccupancy{}
+	var names []string
+	for _, occupancy := range occupancies {
+		if _, ok := byZone[occupancy.Zone]; !ok {
+			names = append(names, occupancy.Zone)
+		}
+		byZone[occupancy.Zone] = append(byZone[occupancy.Zone], occupancy)
+	}
+
+	reports := []ZoneReport{}
+	for _, zone := range zones {
+		reports = append(reports, buildZoneReport(zone, byZone[zone.Name], bucketSize, threshold))
+		delete(byZone, zone.Name)
+	}
+	// the zones of zones were deleted from byZone so only removed ones are left
+	for _, name := range names {
+		if occupancies, ok := byZone[name]; ok {
+			zone := venue.Zone{Name: name, Floor: occupancies[0].Floor}
+			reports = append(reports, buildZoneReport(zone, occupancies, bucketSize, threshold))
+		}
+	}
+	return reports
+}
+
+func buildZoneReport(zone venue.Zone, occupancies []ZoneOccupancy, bucketSize int64, threshold float64) ZoneReport {
+	report := ZoneReport{
+		Zone:     zone.Name,
+		Floor:    zone.Floor,
+		Capacity: zone.Capacity,
+		Buckets:  []OccupancyBucket{},
+		Alerts:   []CapacityAlert{},
+	}
+	if zone.Capacity > 0 {
+		report.Threshold = threshold * float64(zone.Capacity)
+	}
+
+	// the time bucket each device was last seen in and how many
+	// consecutive time buckets its current visit has lasted
+	lastSeen := map[string]uint32{}
+	visitBuckets := map[string]int{}
+	var dwells []int
+	for _, occupancy := range occupancies {
+		devices := len(occupancy.Devices)
+		if devices == 0 {
+			continue
+		}
+		report.Buckets = append(report.Buckets, OccupancyBucket{TimeBucket: occupancy.TimeBucket, Devices: devices})
+		if devices > report.PeakDevices {
+			report.PeakDevices = devices
+		}
+
+		if report.Threshold > 0 && float64(devices) >= report.Threshold {
+			last := len(report.Alerts) - 1
+			if last >= 0 && report.Alerts[last].End+1 == occupancy.TimeBucket {
+				report.Alerts[last].End = occupancy.TimeBucket
+				if devices > report.Alerts[last].PeakDevices {
+					report.Alerts[last].PeakDevices = devices
+				}
+			} else {
+				report.Alerts = append(report.Alerts, CapacityAlert{Start: occupancy.TimeBucket, End: occupancy.TimeBucket, PeakDevices: devices})
+			}
+		}
+
+		for _, device := range occupancy.Devices {
+			if seen, ok := lastSeen[device]; ok && seen+1 == occupancy.TimeBucket {
+				visitBuckets[device]++
+			} else {
+				if ok {
+					dwells = append(dwells, visitBuckets[device])
+				}
+				visitBuckets[device] = 1
+			}
+			lastSeen[device] = occupancy.TimeBucket
+		}
+	}
+
+	report.Visitors = len(visitBuckets)
+	for _, buckets := range visitBuckets {
+		dwells = append(dwells, buckets)
+	}
+	report.Visits = len(dwells)
+
+	minutes := bucketMinutes(bucketSize)
+	total, longest := 0, 0
+	for _, buckets := range dwells {
+		total += buckets
+		if buckets > longest {
+			longest = buckets
+		}
+	}
+	if report.Visits > 0 {
+		report.MeanDwellMinutes = float64(total) * minutes / float64(report.Visits)
+		report.MaxDwellMinutes = float64(longest) * minutes
+	}
+	return report
+}
@@ -0,0 +1,135 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"contact-monitoring-ingest-api/pkg/geo"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var zonedVenue = venue.Config{
+	Venue:          "venue",
+	TimeBucketSize: TimeBucketSize,
+	Floors: &venue.FloorModel{
+		Zones: []venue.Zone{
+			{Name: "east", Polygon: [][]geo.Coord{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}, Capacity: 2},
+			{Name: "west", Polygon: [][]geo.Coord{{{-1, 0}, {0, 0}, {0, 1}, {-1, 1}, {-1, 0}}}},
+		},
+	},
+}
+
+func TestRecordOccupancyMovesDeviceBetweenZones(t *testing.T) {
+	store := NewMemoryStore()
+
+	record := func(device string, lonlat geo.Coord) {
+		event := newEvent(device, 0, lonlat)
+		event.Zone = zoneOf(zonedVenue, event)
+		if err := recordOccupancy(store, zonedVenue, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record("a", geo.Coord{0.5, 0.5})
+	record("a", geo.Coord{0.5, 0.5})
+	record("b", geo.Coord{0.5, 0.5})
+	// a later event of b replaced the first one in another zone
+	record("b", geo.Coord{-0.5, 0.5})
+
+	occupancies, err := store.FindOccupancy(OccupancyQuery{Venue: "venue", BucketSize: TimeBucketSize, From: 0, To: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := map[string][]string{}
+	for _, occupancy := range occupancies {
+		devices[occupancy.Zone] = occupancy.Devices
+	}
+	expected := map[string][]string{"east": {"a"}, "west": {"b"}}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("expected %v but got %v", expected, devices)
+	}
+}
+
+func TestBuildZoneReports(t *testing.T) {
+	occupancies := []ZoneOccupancy{
+		{Zone: "east", TimeBucket: 10, Devices: []string{"a"}},
+		{Zone: "east", TimeBucket: 11, Devices: []string{"a", "b"}},
+		{Zone: "east", TimeBucket: 12, Devices: []string{"a", "b", "c"}},
+		{Zone: "east", TimeBucket: 14, Devices: []string{"b", "c"}},
+		{Zone: "lobby", Floor: 2, TimeBucket: 10, Devices: []string{"d"}},
+	}
+
+	reports := buildZoneReports(zonedVenue.Floors.Zones, occupancies, TimeBucketSize, 1)
+	if len(reports) != 3 {
+		t.Fatalf("expected reports of east, west and the removed lobby but got %+v", reports)
+	}
+
+	east := reports[0]
+	if east.PeakDevices != 3 || east.Visitors != 3 || east.Threshold != 2 {
+		t.Errorf("expected a peak of 3 devices from 3 visitors with a threshold of 2 but got %+v", east)
+	}
+	// a stays 3 minutes, b 2 then 1, c 1 then 1
+	if east.Visits != 5 || east.MeanDwellMinutes != 8.0/5 || east.MaxDwellMinutes != 3 {
+		t.Errorf("expected 5 visits of 1.6 minutes and at most 3 but got %+v", east)
+	}
+	alerts := []CapacityAlert{{Start: 11, End: 12, PeakDevices: 3}, {Start: 14, End: 14, PeakDevices: 2}}
+	if !reflect.DeepEqual(east.Alerts, alerts) {
+		t.Errorf("expected alerts %+v but got %+v", alerts, east.Alerts)
+	}
+
+	if west := reports[1]; west.Zone != "west" || len(west.Buckets) != 0 || len(west.Alerts) != 0 {
+		t.Errorf("expected an empty report of west but got %+v", west)
+	}
+	if lobby := reports[2]; lobby.Zone != "lobby" || lobby.Floor != 2 || lobby.PeakDevices != 1 {
+		t.Errorf("expected a report of the lobby but got %+v", lobby)
+	}
+}
+
+func TestPostHandlerTagsZone(t *testing.T) {
+	store := NewMemoryStore()
+	config := zonedVenue
+	config.AccuracyThreshold = 5
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:        store,
+		Broker:       NewChannelBroker(10, 1, 10),
+		Venues:       venue.Fixed(config),
+		QueueTimeout: time.Second,
+	})
+
+	responses := postBatch(t, router, []PositionEvent{
+		newEvent("a", 100, geo.Coord{0.5, 0.5}),
+		newEvent("a", 101, geo.Coord{5, 5}),
+	})
+	if responses[0].Status != http.StatusOK || responses[1].Status != http.StatusOK {
+		t.Fatalf("expected [200, 200] but got %v", responses)
+	}
+
+	for bucket, zone := range map[uint32]string{100: "east", 101: ""} {
+		events, _ := store.FindVenueEvents("venue", TimeBucketSize, bucket)
+		if len(events) != 1 || events[0].Zone != zone {
+			t.Errorf("expected the event of time bucket %d in zone %q but got %v", bucket, zone, events)
+		}
+	}
+}
+
+func TestGetOccupancyHandlerAcceptsFromZero(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/venues/:venue/occupancy", GetOccupancyHandler(NewMemoryStore(), testVenues))
+
+	for query, status := range map[string]int{
+		"?from=0&to=60000": http.StatusOK,
+		"?to=60000":        http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/venues/venue/occupancy"+query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("expected %s to get %d but got %d: %s", query, status, w.Code, w.Body.String())
+		}
+	}
+}
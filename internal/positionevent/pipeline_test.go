@@ -0,0 +1,656 @@
+package positionevent
+
+import (
+	"bytes"
+	"contact-monitoring-ingest-api/internal/auth"
+	"contact-monitoring-ingest-api/internal/device"
+	"contact-monitoring-ingest-api/internal/venue"
+	"contact-monitoring-ingest-api/pkg/geo"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testVenues = venue.Fixed(venue.Config{
+	AccuracyThreshold: 5,
+	ContactDistance:   5,
+	TimeBucketSize:    TimeBucketSize,
+})
+
+// startWorkers runs an EventWorker and AggregateWorker backed by store and
+// a ChannelBroker. Calling stop closes the broker and waits for both workers
+// to drain it.
+func startWorkers(store Store) (broker Broker, stop func()) {
+	broker = NewChannelBroker(100, 1, 100)
+
+	var eventWG, aggregateWG sync.WaitGroup
+	eventWG.Add(1)
+	go EventWorker(EventWorkerConfig{
+		Store:          store,
+		Broker:         broker,
+		PublishTimeout: time.Second,
+		WG:             &eventWG,
+		Venues:         testVenues,
+		Rule:           AccuracyWeightedRule,
+	})
+	aggregateWG.Add(1)
+	go AggregateWorker(AggregateWorkerConfig{
+		Store:            store,
+		MinAggregateChan: broker.MinuteAggregates(0),
+		WG:               &aggregateWG,
+	})
+
+	stop = func() {
+		broker.CloseEvents()
+		eventWG.Wait()
+		broker.CloseMinuteAggregates()
+		aggregateWG.Wait()
+	}
+	return
+}
+
+// newPositionsRouter serves PostHandler as if every request had a token
+// for device a at venue
+func newPositionsRouter(config PostHandlerConfig) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/positions", func(c *gin.Context) {
+		c.Set("claims", &auth.Claims{Venue: "venue", StandardClaims: jwt.StandardClaims{Subject: "a"}})
+	}, PostHandler(config))
+	return router
+}
+
+func postBatch(t *testing.T, router *gin.Engine, batch []PositionEvent) []httpResponse {
+	return postBatchSentAt(t, router, batch, "")
+}
+
+// postBatchSentAt posts batch with sentAt as the SentAtHeader unless empty
+func postBatchSentAt(t *testing.T, router *gin.Engine, batch []PositionEvent, sentAt string) []httpResponse {
+	body, _ := json.Marshal(batch)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/positions", bytes.NewReader(body))
+	if sentAt != "" {
+		req.Header.Set(SentAtHeader, sentAt)
+	}
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusMultiStatus, w.Code, w.Body.String())
+	}
+
+	var response []httpResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// runPipeline posts each batch of events through PostHandler and runs them
+// through an EventWorker and AggregateWorker backed by store
+func runPipeline(t *testing.T, store Store, batches ...[]PositionEvent) [][]httpResponse {
+	broker, stop := startWorkers(store)
+
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:        store,
+		Broker:       broker,
+		Venues:       testVenues,
+		QueueTimeout: time.Second,
+	})
+
+	var responses [][]httpResponse
+	for _, batch := range batches {
+		responses = append(responses, postBatch(t, router, batch))
+	}
+
+	stop()
+
+	return responses
+}
+
+func newEvent(device string, minute int64, lonlat geo.Coord) PositionEvent {
+	return PositionEvent{
+		DeviceID:    device,
+		Time:        minute*TimeBucketSize + 1000,
+		LonLat:      lonlat,
+		Accuracy:    2,
+		Floor:       0,
+		UserConsent: true,
+		Venue:       "venue",
+	}
+}
+
+func TestPipelineMergesConsecutiveMinutesIntoContact(t *testing.T) {
+	store := NewMemoryStore()
+	a := geo.Coord{43.482928, -80.535819}
+	b := geo.Coord{43.482889, -80.535771}
+
+	// whichever event of a minute is processed second always finds the
+	// first in its nearby query, so the order the worker sees them is irrelevant
+	var batches [][]PositionEvent
+	for minute := int64(100); minute < 103; minute++ {
+		batches = append(batches, []PositionEvent{newEvent("a", minute, a)})
+		batches = append(batches, []PositionEvent{newEvent("b", minute, b)})
+	}
+	runPipeline(t, store, batches...)
+
+	contacts, err := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(contacts) != 1 {
+		t.Fatalf("expected 1 contact but got %d: %v", len(contacts), contacts)
+	}
+	if contacts[0].Start != 100 || contacts[0].End != 102 || contacts[0].Duration != 3 {
+		t.Errorf("expected contact from 100 to 102 lasting 3 but got %v", contacts[0])
+	}
+}
+
+func TestPipelineRejectsSecondEventInBucket(t *testing.T) {
+	store := NewMemoryStore()
+	a := geo.Coord{43.482928, -80.535819}
+
+	responses := runPipeline(t, store,
+		[]PositionEvent{newEvent("a", 100, a), newEvent("a", 100, a)},
+		[]PositionEvent{newEvent("a", 100, a)},
+	)
+
+	if responses[0][0].Status != http.StatusOK || responses[0][1].Status != http.StatusConflict {
+		t.Errorf("expected first batch to be [200, 409] but got %v", responses[0])
+	}
+	if responses[1][0].Status != http.StatusConflict {
+		t.Errorf("expected second batch to be [409] but got %v", responses[1])
+	}
+}
+
+func TestPostHandlerInterpolatesShortGaps(t *testing.T) {
+	store := NewMemoryStore()
+	broker, stop := startWorkers(store)
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:               store,
+		Broker:              broker,
+		Venues:              testVenues,
+		QueueTimeout:        time.Second,
+		InterpolationMaxGap: 2 * time.Minute,
+	})
+	a := geo.Coord{43.482928, -80.535819}
+	b := geo.Coord{43.482889, -80.535771}
+
+	// a reports every 3 minutes and b every minute in between
+	postBatch(t, router, []PositionEvent{newEvent("a", 100, a)})
+	postBatch(t, router, []PositionEvent{newEvent("b", 101, b)})
+	postBatch(t, router, []PositionEvent{newEvent("b", 102, b)})
+	postBatch(t, router, []PositionEvent{newEvent("a", 103, a)})
+	// a gap of 3 minutes is too long to interpolate
+	postBatch(t, router, []PositionEvent{newEvent("a", 107, a)})
+	stop()
+
+	for _, minute := range []uint32{101, 102} {
+		events, _ := store.FindVenueEvents("venue", TimeBucketSize, minute)
+		if len(events) != 2 {
+			t.Fatalf("expected an interpolated event of a in minute %d but got %v", minute, events)
+		}
+	}
+	if events, _ := store.FindVenueEvents("venue", TimeBucketSize, 105); len(events) != 0 {
+		t.Errorf("expected no interpolated events across a long gap but got %v", events)
+	}
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 || contacts[0].Start != 101 || contacts[0].End != 102 {
+		t.Fatalf("expected a contact from 101 to 102 but got %v", contacts)
+	}
+	for _, minuteAggregate := range store.MinuteAggregates() {
+		if !minuteAggregate.Events[0].Interpolated || minuteAggregate.Events[1].Interpolated {
+			t.Errorf("expected only the event of a to be interpolated but got %v", minuteAggregate.Events)
+		}
+	}
+}
+
+func TestPostHandlerReplacesInterpolatedEventUnderFirstSelection(t *testing.T) {
+	store := NewMemoryStore()
+	config := PostHandlerConfig{
+		Store:               store,
+		Venues:              testVenues,
+		QueueTimeout:        time.Second,
+		Selection:           FirstSelection,
+		InterpolationMaxGap: 2 * time.Minute,
+	}
+	a := geo.Coord{43.482928, -80.535819}
+	b := geo.Coord{43.482889, -80.535771}
+
+	// a is interpolated in minute 101, where it is in contact with b
+	broker, stop := startWorkers(store)
+	config.Broker = broker
+	router := newPositionsRouter(config)
+	postBatch(t, router, []PositionEvent{newEvent("a", 100, a)})
+	postBatch(t, router, []PositionEvent{newEvent("b", 101, b)})
+	postBatch(t, router, []PositionEvent{newEvent("a", 102, a)})
+	stop()
+
+	// then the position a measured in minute 101 arrives late
+	broker, stop = startWorkers(store)
+	config.Broker = broker
+	router = newPositionsRouter(config)
+	response := postBatch(t, router, []PositionEvent{newEvent("a", 101, b)})
+	stop()
+
+	if response[0].Status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v", response[0])
+	}
+	events, _ := store.FindVenueEvents("venue", TimeBucketSize, 101)
+	for _, event := range events {
+		if event.DeviceID == "a" && (event.Interpolated || event.LonLat != b) {
+			t.Errorf("expected the measured position of a to be stored but got %v", event)
+		}
+	}
+
+	minuteAggregates := store.MinuteAggregates()
+	if len(minuteAggregates) != 1 || minuteAggregates[0].Events[0].Interpolated || minuteAggregates[0].Distance != 0 {
+		t.Fatalf("expected a minute aggregate derived from the measured position but got %v", minuteAggregates)
+	}
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 || contacts[0].Duration != 1 || contacts[0].MinuteAggregates[0] != minuteAggregates[0].ID {
+		t.Errorf("expected a contact of the one minute aggregate but got %v", contacts)
+	}
+	exposures, _ := store.FindDaily(DailyExposureQuery{Device: "a", From: 0, To: 1000})
+	if len(exposures) != 1 || exposures[0].Minutes != 1 {
+		t.Errorf("expected 1 minute of daily exposure but got %v", exposures)
+	}
+}
+
+func TestPostHandlerReplacesLowerQualityEvent(t *testing.T) {
+	store := NewMemoryStore()
+	broker, stop := startWorkers(store)
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:        store,
+		Broker:       broker,
+		Venues:       testVenues,
+		QueueTimeout: time.Second,
+		Selection:    AccuracySelection,
+	})
+	a := geo.Coord{43.482928, -80.535819}
+
+	send := func(accuracy float32) int {
+		event := newEvent("a", 100, a)
+		event.Accuracy = accuracy
+		return postBatch(t, router, []PositionEvent{event})[0].Status
+	}
+	statuses := []int{send(4), send(2), send(3)}
+	stop()
+
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusOK || statuses[2] != http.StatusConflict {
+		t.Errorf("expected [200, 200, 409] but got %v", statuses)
+	}
+	events, _ := store.FindVenueEvents("venue", TimeBucketSize, 100)
+	if len(events) != 1 || events[0].Accuracy != 2 {
+		t.Errorf("expected the event with accuracy 2 to be stored but got %v", events)
+	}
+}
+
+func TestPostHandlerDerivesMinuteAggregatesOfReplacingEventAgain(t *testing.T) {
+	store := NewMemoryStore()
+	config := PostHandlerConfig{
+		Store:        store,
+		Venues:       testVenues,
+		QueueTimeout: time.Second,
+		Selection:    AccuracySelection,
+	}
+	a := geo.Coord{43.482928, -80.535819}
+	b := geo.Coord{43.482889, -80.535771}
+
+	broker, stop := startWorkers(store)
+	config.Broker = broker
+	router := newPositionsRouter(config)
+	for minute := int64(100); minute < 103; minute++ {
+		postBatch(t, router, []PositionEvent{newEvent("a", minute, a)})
+		postBatch(t, router, []PositionEvent{newEvent("b", minute, b)})
+	}
+	stop()
+
+	distance := func() float64 {
+		for _, minuteAggregate := range store.MinuteAggregates() {
+			if minuteAggregate.TimeBucket == 101 {
+				return minuteAggregate.Distance
+			}
+		}
+		t.Fatal("expected a minute aggregate in minute 101")
+		return 0
+	}
+	if distance() == 0 {
+		t.Fatal("expected a and b apart in minute 101")
+	}
+
+	// a more accurate position of a in minute 101 puts it right next to b
+	broker, stop = startWorkers(store)
+	config.Broker = broker
+	router = newPositionsRouter(config)
+	event := newEvent("a", 101, b)
+	event.Accuracy = 1
+	response := postBatch(t, router, []PositionEvent{event})
+	stop()
+
+	if response[0].Status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v", response[0])
+	}
+	if len(store.MinuteAggregates()) != 3 || distance() != 0 {
+		t.Errorf("expected the minute aggregate of minute 101 derived from the replacing position but got %v", store.MinuteAggregates())
+	}
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 || contacts[0].Start != 100 || contacts[0].End != 102 || contacts[0].Duration != 3 || contacts[0].MinDistance != 0 {
+		t.Errorf("expected a contact from 100 to 102 lasting 3 minutes down to 0m but got %v", contacts)
+	}
+	exposures, _ := store.FindDaily(DailyExposureQuery{Device: "a", From: 0, To: 1000})
+	if len(exposures) != 1 || exposures[0].Minutes != 3 {
+		t.Errorf("expected 3 minutes of daily exposure but got %v", exposures)
+	}
+}
+
+// failingDeleteStore fails to delete what was derived from replaced events
+type failingDeleteStore struct {
+	*MemoryStore
+}
+
+func (s failingDeleteStore) DeleteEventDerived(event PositionEvent) (remerge []MinuteAggregate, err error) {
+	return nil, errors.New("delete failed")
+}
+
+func TestReplayDerivesReplacingEventAgainAfterDeleteFailed(t *testing.T) {
+	store := NewMemoryStore()
+	a := geo.Coord{43.482928, -80.535819}
+	b := geo.Coord{43.482889, -80.535771}
+
+	broker, stop := startWorkers(store)
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:        store,
+		Broker:       broker,
+		Venues:       testVenues,
+		QueueTimeout: time.Second,
+		Selection:    AccuracySelection,
+	})
+	for minute := int64(100); minute < 103; minute++ {
+		postBatch(t, router, []PositionEvent{newEvent("a", minute, a)})
+		postBatch(t, router, []PositionEvent{newEvent("b", minute, b)})
+	}
+	stop()
+
+	// the replacing event isn't published while the minute aggregate of
+	// the event it replaced is still there
+	broker = NewChannelBroker(10, 1, 10)
+	router = newPositionsRouter(PostHandlerConfig{
+		Store:        failingDeleteStore{store},
+		Broker:       broker,
+		Venues:       testVenues,
+		QueueTimeout: time.Second,
+		Selection:    AccuracySelection,
+	})
+	event := newEvent("a", 101, b)
+	event.Accuracy = 1
+	response := postBatch(t, router, []PositionEvent{event})
+	if response[0].Status != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 but got %v", response[0])
+	}
+	select {
+	case published := <-broker.Events():
+		t.Fatalf("expected no event to be published but got %v", published)
+	default:
+	}
+
+	broker, stop = startWorkers(store)
+	if _, events, err := Replay(store, time.Now().Add(time.Second), broker); err != nil || events != 1 {
+		t.Fatalf("expected the replacing event to be replayed but got %d %v", events, err)
+	}
+	stop()
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 || contacts[0].Duration != 3 || contacts[0].MinDistance != 0 {
+		t.Errorf("expected a contact lasting 3 minutes down to 0m but got %v", contacts)
+	}
+	exposures, _ := store.FindDaily(DailyExposureQuery{Device: "a", From: 0, To: 1000})
+	if len(exposures) != 1 || exposures[0].Minutes != 3 {
+		t.Errorf("expected 3 minutes of daily exposure but got %v", exposures)
+	}
+}
+
+func TestPostHandlerTurnsAwayEventsLeftOutOfCentroid(t *testing.T) {
+	store := NewMemoryStore()
+	samples := bucketSamples()
+	samples[1].Floor = 1
+
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:        store,
+		Broker:       NewChannelBroker(10, 1, 10),
+		Venues:       testVenues,
+		QueueTimeout: time.Second,
+		Selection:    CentroidSelection,
+	})
+	response := postBatch(t, router, samples)
+
+	statuses := []int{response[0].Status, response[1].Status, response[2].Status}
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusConflict || statuses[2] != http.StatusOK {
+		t.Errorf("expected [200, 409, 200] but got %v", statuses)
+	}
+}
+
+func TestReplayProcessesEventsLeftPending(t *testing.T) {
+	store := NewMemoryStore()
+	a := geo.Coord{43.482928, -80.535819}
+	b := geo.Coord{43.482889, -80.535771}
+
+	// stored by a previous process that stopped before the workers ran
+	for _, event := range []PositionEvent{newEvent("a", 100, a), newEvent("b", 100, b)} {
+		event.TimeBucket = 100
+		event.Pending = true
+		if _, err := store.InsertEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker, stop := startWorkers(store)
+
+	_, events, err := Replay(store, time.Now().Add(time.Second), broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events != 2 {
+		t.Errorf("expected 2 events to be replayed but got %d", events)
+	}
+
+	stop()
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 {
+		t.Errorf("expected 1 contact but got %d", len(contacts))
+	}
+
+	pending, _ := store.PendingEvents(primitive.NilObjectID, primitive.NewObjectIDFromTimestamp(time.Now().Add(time.Second)), 10)
+	if len(pending) != 0 {
+		t.Errorf("expected no pending events after replay but got %d", len(pending))
+	}
+}
+
+func TestPostHandlerThrottlesWhenQueueIsFull(t *testing.T) {
+	store := NewMemoryStore()
+	a := geo.Coord{43.482928, -80.535819}
+
+	// nothing consumes the queue so only the first event fits
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:        store,
+		Broker:       NewChannelBroker(1, 1, 1),
+		Venues:       testVenues,
+		QueueTimeout: 10 * time.Millisecond,
+	})
+
+	response := postBatch(t, router, []PositionEvent{
+		newEvent("a", 100, a),
+		newEvent("a", 101, a),
+		newEvent("a", 102, a),
+	})
+
+	expected := []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusTooManyRequests}
+	for i, status := range expected {
+		if response[i].Status != status {
+			t.Errorf("expected event %d to have status %d but got %d", i, status, response[i].Status)
+		}
+	}
+
+	// the event that timed out was rolled back so it can be sent again
+	if _, err := store.InsertEvent(PositionEvent{DeviceID: "a", TimeBucket: 101}); err != nil {
+		t.Errorf("expected timed out event to be removed but got %v", err)
+	}
+}
+
+func TestPostHandlerRejectsFutureAndLateEvents(t *testing.T) {
+	store := NewMemoryStore()
+	a := geo.Coord{43.482928, -80.535819}
+
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:           store,
+		Broker:          NewChannelBroker(10, 1, 10),
+		Venues:          testVenues,
+		QueueTimeout:    10 * time.Millisecond,
+		MaxClockSkew:    time.Minute,
+		AllowedLateness: time.Hour,
+	})
+
+	now := time.Now().UnixNano() / int64(time.Millisecond) / TimeBucketSize
+	response := postBatch(t, router, []PositionEvent{
+		newEvent("a", now-120, a),
+		newEvent("a", now-30, a),
+		newEvent("a", now+5, a),
+	})
+
+	expected := []int{http.StatusGone, http.StatusOK, http.StatusUnprocessableEntity}
+	for i, status := range expected {
+		if response[i].Status != status {
+			t.Errorf("expected event %d to have status %d but got %d: %s", i, status, response[i].Status, response[i].Message)
+		}
+	}
+}
+
+// fakeDevices is a device.Repo of devices kept in memory that only
+// implements the methods PostHandler uses
+type fakeDevices struct {
+	device.Repo
+	devices map[string]*device.Device
+}
+
+func (d *fakeDevices) Get(id string) (*device.Device, error) {
+	found := *d.devices[id]
+	return &found, nil
+}
+
+func (d *fakeDevices) SetClockOffset(id string, offset int64) error {
+	d.devices[id].ClockOffset = offset
+	return nil
+}
+
+func TestPostHandlerCorrectsDeviceClockOffset(t *testing.T) {
+	store := NewMemoryStore()
+	devices := &fakeDevices{devices: map[string]*device.Device{"a": {ID: "a"}}}
+	a := geo.Coord{43.482928, -80.535819}
+
+	router := newPositionsRouter(PostHandlerConfig{
+		Store:        store,
+		Broker:       NewChannelBroker(10, 1, 10),
+		Venues:       testVenues,
+		Devices:      devices,
+		QueueTimeout: 10 * time.Millisecond,
+	})
+
+	// the clock of device a is 90 seconds fast
+	const offset = 90 * 1000
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	minute := now/TimeBucketSize - 2
+	event := newEvent("a", minute, a)
+	event.Time += offset
+
+	sentAt := strconv.FormatInt(now+offset, 10)
+	if response := postBatchSentAt(t, router, []PositionEvent{event}, sentAt); response[0].Status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v", response[0])
+	}
+
+	stored, _ := store.FindVenueEvents("venue", TimeBucketSize, uint32(minute))
+	if len(stored) != 1 {
+		t.Fatalf("expected the event in time bucket %d but got %v", minute, stored)
+	}
+	if stored[0].RawTime != event.Time || stored[0].ClockOffset < offset-1000 || stored[0].ClockOffset > offset {
+		t.Errorf("expected raw time %d corrected by about %d but got %v", event.Time, offset, stored[0])
+	}
+	if devices.devices["a"].ClockOffset != stored[0].ClockOffset {
+		t.Errorf("expected the offset to be stored on the device but got %d", devices.devices["a"].ClockOffset)
+	}
+
+	// the offset of device a isn't applied to the events of other devices
+	other := newEvent("b", minute, a)
+	postBatchSentAt(t, router, []PositionEvent{other}, sentAt)
+	stored, _ = store.FindVenueEvents("venue", TimeBucketSize, uint32(minute))
+	for _, e := range stored {
+		if e.DeviceID == "b" && (e.ClockOffset != 0 || e.Time != other.Time) {
+			t.Errorf("expected the event of b not to be corrected but got %v", e)
+		}
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected the events of a and b in time bucket %d but got %v", minute, stored)
+	}
+
+	// batches without the header are corrected by the stored offset
+	event = newEvent("a", minute+1, a)
+	event.Time += offset
+	postBatch(t, router, []PositionEvent{event})
+
+	if stored, _ := store.FindVenueEvents("venue", TimeBucketSize, uint32(minute+1)); len(stored) != 1 {
+		t.Errorf("expected the event in time bucket %d but got %v", minute+1, stored)
+	}
+}
+
+func TestPostHandlerCorrectsClockOffsetOfTokensWithoutDevice(t *testing.T) {
+	store := NewMemoryStore()
+	devices := &fakeDevices{devices: map[string]*device.Device{}}
+	a := geo.Coord{43.482928, -80.535819}
+
+	// a token issued before tokens named their device
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/positions", func(c *gin.Context) {
+		c.Set("claims", &auth.Claims{Venue: "venue"})
+	}, PostHandler(PostHandlerConfig{
+		Store:        store,
+		Broker:       NewChannelBroker(10, 1, 10),
+		Venues:       testVenues,
+		Devices:      devices,
+		QueueTimeout: 10 * time.Millisecond,
+	}))
+
+	// the clock of the device is 90 seconds fast
+	const offset = 90 * 1000
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	minute := now/TimeBucketSize - 2
+	event := newEvent("a", minute, a)
+	event.Time += offset
+
+	sentAt := strconv.FormatInt(now+offset, 10)
+	if response := postBatchSentAt(t, router, []PositionEvent{event}, sentAt); response[0].Status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %v", response[0])
+	}
+
+	stored, _ := store.FindVenueEvents("venue", TimeBucketSize, uint32(minute))
+	if len(stored) != 1 {
+		t.Fatalf("expected the event in time bucket %d but got %v", minute, stored)
+	}
+	if stored[0].ClockOffset < offset-1000 || stored[0].ClockOffset > offset {
+		t.Errorf("expected the event corrected by about %d but got %v", offset, stored[0])
+	}
+	if len(devices.devices) != 0 {
+		t.Errorf("expected no device offset to be stored but got %v", devices.devices)
+	}
+}
@@ -0,0 +1,135 @@
+package positionevent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const replayPageSize int64 = 1000
+
+// ReplayLease is the lease held by the one process that replays and
+// redelivers pending work, so that with several event worker replicas
+// every pending item is published again once rather than once per replica
+const ReplayLease = "replay"
+
+// Lease is held by Holder until Expires, after which any process can
+// acquire it
+type Lease struct {
+	Name    string    `bson:"_id"`
+	Holder  string    `bson:"holder"`
+	Expires time.Time `bson:"expires"`
+}
+
+// Replay publishes the minute aggregates and position events that were stored
+// before startedAt but never acknowledged to the broker again, so work
+// that was in flight when a previous process stopped is not lost. Minute
+// aggregates are replayed first since they are the later pipeline stage.
+// Whatever was derived from an event before is deleted when it is
+// replayed, like for a replaced event, which also picks up what a failed
+// DeleteEventDerived left behind. It returns the number of minute
+// aggregates and events replayed.
+func Replay(
+	store Store,
+	startedAt time.Time,
+	broker Broker,
+) (aggregates int, events int, err error) {
+	ctx := context.Background()
+	before := primitive.NewObjectIDFromTimestamp(startedAt)
+
+	after := primitive.NilObjectID
+	for {
+		page, err := store.PendingMinuteAggregates(after, before, replayPageSize)
+		if err != nil {
+			return aggregates, events, err
+		}
+		for _, minAggregate := range page {
+			if err := broker.PublishMinuteAggregate(ctx, minAggregate); err != nil {
+				return aggregates, events, err
+			}
+			after = minAggregate.ID
+		}
+		aggregates += len(page)
+		if int64(len(page)) < replayPageSize {
+			break
+		}
+	}
+
+	after = primitive.NilObjectID
+	for {
+		page, err := store.PendingEvents(after, before, replayPageSize)
+		if err != nil {
+			return aggregates, events, err
+		}
+		for _, event := range page {
+			remerge, err := store.DeleteEventDerived(event)
+			if err != nil {
+				return aggregates, events, err
+			}
+			if err := broker.PublishEvent(ctx, event); err != nil {
+				return aggregates, events, err
+			}
+			for _, minAggregate := range remerge {
+				if err := broker.PublishMinuteAggregate(ctx, minAggregate); err != nil {
+					return aggregates, events, err
+				}
+			}
+			aggregates += len(remerge)
+			after = event.ID
+		}
+		events += len(page)
+		if int64(len(page)) < replayPageSize {
+			break
+		}
+	}
+
+	return aggregates, events, nil
+}
+
+// Redeliver replays items that have been pending for longer than maxAge
+// every interval until stop is closed. This picks up work that was put
+// aside because a queue stayed full, eg. a minute aggregate that could not
+// be published in time. It only replays while holder holds ReplayLease,
+// which it renews for leaseTTL on every interval, so leaseTTL has to be
+// longer than interval. When the holder stops, another process acquires
+// the lease once it expires.
+func Redeliver(
+	store Store,
+	holder string,
+	interval time.Duration,
+	leaseTTL time.Duration,
+	maxAge time.Duration,
+	broker Broker,
+	stop chan struct{},
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			leased, err := store.AcquireLease(ReplayLease, holder, leaseTTL)
+			if err != nil {
+				log.Println("error acquiring the replay lease", err)
+				continue
+			}
+			if !leased {
+				continue
+			}
+			aggregates, events, err := Replay(store, time.Now().Add(-maxAge), broker)
+			if err != nil {
+				log.Println("error redelivering pending events", err)
+			} else if aggregates > 0 || events > 0 {
+				log.Printf("Redelivered %d pending minute aggregates and %d pending position events\n", aggregates, events)
+			}
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package positionevent
 
 import (
+	"contact-monitoring-ingest-api/internal/venue"
 	"contact-monitoring-ingest-api/pkg/geo"
+	"context"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // PositionEvent represents a spatial and temporal position of a device
@@ -17,35 +22,163 @@ type PositionEvent struct {
 	UserConsent bool               `bson:"userConsent" json:"userConsent" binding:"required"`
 	Venue       string             `bson:"venue" json:"venue" binding:"required"`
 	TimeBucket  uint32             `bson:"timeBucket"`
+	// BucketSize is the length in milliseconds of TimeBucket, as
+	// configured for the venue when the event was received
+	BucketSize int64 `bson:"bucketSize,omitempty" json:"-"`
+	Pending    bool  `bson:"pending,omitempty" json:"-"`
+	// RawTime is the time the device sent when Time was corrected by
+	// ClockOffset, the milliseconds its clock was ahead of the server
+	RawTime     int64 `bson:"rawTime,omitempty" json:"-"`
+	ClockOffset int64 `bson:"clockOffset,omitempty" json:"-"`
+	// Quality scores the event by the SelectionStrategy it was stored with
+	// so that an event of higher quality can replace it
+	Quality float64 `bson:"quality,omitempty" json:"-"`
+	// Interpolated is set on events the server placed between two sparse
+	// positions of a device rather than the device sent
+	Interpolated bool `bson:"interpolated,omitempty" json:"-"`
+	// Zone is the name of the zone of the venue the event was in when it
+	// was received, if any
+	Zone string `bson:"zone,omitempty" json:"-"`
 }
 
 // PartialPositionEvent represents a small view of a position event used in
 // a minute aggregation
 type PartialPositionEvent struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty"`
-	DeviceID string             `bson:"device"`
-	LonLat   geo.Coord          `bson:"lonlat"`
-	Accuracy float32            `bson:"accuracy"`
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	DeviceID string             `bson:"device" json:"device"`
+	LonLat   geo.Coord          `bson:"lonlat" json:"lonlat"`
+	Accuracy float32            `bson:"accuracy" json:"acc"`
+	// Interpolated is set when the event was interpolated
+	Interpolated bool `bson:"interpolated,omitempty" json:"interpolated,omitempty"`
 }
 
 // MinuteAggregate represents a contact between two people at a time derived from two position events
 type MinuteAggregate struct {
-	ID         primitive.ObjectID      `bson:"_id,omitempty"`
-	TimeBucket uint32                  `bson:"timeBucket,omitempty"`
-	Events     [2]PartialPositionEvent `bson:"events"`
-	Distance   float64                 `bson:"distance,omitempty"`
-	Floor      int16                   `bson:"floor"`
+	ID         primitive.ObjectID      `bson:"_id,omitempty" json:"id,omitempty"`
+	TimeBucket uint32                  `bson:"timeBucket,omitempty" json:"timeBucket,omitempty"`
+	BucketSize int64                   `bson:"bucketSize,omitempty" json:"bucketSize,omitempty"`
+	Events     [2]PartialPositionEvent `bson:"events" json:"events"`
+	Distance   float64                 `bson:"distance,omitempty" json:"distance,omitempty"`
+	Floor      int16                   `bson:"floor" json:"floor"`
+	Venue      string                  `bson:"venue,omitempty" json:"venue,omitempty"`
+	// Rule is the DistanceRule that matched the events and Score how much
+	// it supports the contact, from 0 to 1
+	Rule  DistanceRule `bson:"rule,omitempty" json:"rule,omitempty"`
+	Score float64      `bson:"score,omitempty" json:"score,omitempty"`
+	// Probability is the ContactProbability of the events whichever rule
+	// matched them
+	Probability float64 `bson:"probability" json:"probability"`
+	Pending     bool    `bson:"pending,omitempty" json:"-"`
 }
 
-// ContactEvent is the aggregation of the MinuteAggregate between two people over a length of time
+// ContactEvent is the aggregation of the MinuteAggregate between two people over a length of time.
+// Start and End are time buckets of BucketSize milliseconds and Duration is
+// the number of minutes of the time buckets the devices were in contact.
 type ContactEvent struct {
-	ID               primitive.ObjectID   `bson:"_id,omitempty"`
-	Devices          [2]string            `bson:"devices"`
-	Start            uint32               `bson:"start"`
-	End              uint32               `bson:"end"`
-	MinuteAggregates []primitive.ObjectID `bson:"minuteaggregates"`
-	Duration         int                  `bson:"duration"`
-	FirstContact     MinuteAggregate      `bson:"firstcontact"`
-	MinDistance      float64              `bson:"mindistance"`
-	MaxDistance      float64              `bson:"maxdistance"`
+	ID               primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	Devices          [2]string            `bson:"devices" json:"devices"`
+	Start            uint32               `bson:"start" json:"start"`
+	End              uint32               `bson:"end" json:"end"`
+	BucketSize       int64                `bson:"bucketSize,omitempty" json:"bucketSize"`
+	MinuteAggregates []primitive.ObjectID `bson:"minuteaggregates" json:"minuteAggregates"`
+	Duration         float64              `bson:"duration" json:"duration"`
+	FirstContact     MinuteAggregate      `bson:"firstcontact" json:"firstContact"`
+	MinDistance      float64              `bson:"mindistance" json:"minDistance"`
+	MaxDistance      float64              `bson:"maxdistance" json:"maxDistance"`
+	// ExposureMinutes is the expected number of minutes the devices were
+	// in contact, the sum of the Probability of the minute aggregates
+	ExposureMinutes float64 `bson:"exposureMinutes" json:"exposureMinutes"`
+	Venue           string  `bson:"venue,omitempty" json:"venue,omitempty"`
+	// StartTime is Start in milliseconds since epoch, which sorts contact
+	// events of different BucketSize together
+	StartTime int64 `bson:"startTime" json:"-"`
+}
+
+// ContactQuery describes a filter over contact events for a single device.
+// From and To are time buckets of TimeBucketSize and a contact matches when
+// any part of it falls within [From, To], whatever the size of its own time
+// buckets. MinDuration is in minutes. Zero values of the optional fields
+// are ignored.
+type ContactQuery struct {
+	Device      string
+	From        uint32
+	To          uint32
+	MinDuration int
+	MaxDistance float64
+	Venue       string
+	Offset      int64
+	Limit       int64
+}
+
+// ContactRepo is an interface for reading contact events
+// from their persistence layer
+type ContactRepo interface {
+	Find(query ContactQuery) (contacts []ContactEvent, err error)
+}
+
+type contactRepo struct {
+	col *mongo.Collection
+}
+
+// NewContactRepo returns a new ContactRepo interface
+func NewContactRepo(col *mongo.Collection) ContactRepo {
+	return &contactRepo{
+		col,
+	}
+}
+
+// Find returns the contact events involving query.Device that overlap the
+// query time range, sorted by start.
+func (r *contactRepo) Find(query ContactQuery) (contacts []ContactEvent, err error) {
+	ranges := bson.A{}
+	for _, size := range venue.TimeBucketSizes {
+		from, to := bucketRange(query.From, query.To, size)
+		ranges = append(ranges, bson.M{
+			"bucketSize": bucketSizeFilter(size),
+			"end": bson.M{
+				"$gte": from,
+			},
+			"start": bson.M{
+				"$lte": to,
+			},
+		})
+	}
+	filter := bson.M{
+		"devices": query.Device,
+		"$or":     ranges,
+	}
+	if query.MinDuration > 0 {
+		filter["duration"] = bson.M{"$gte": query.MinDuration}
+	}
+	if query.MaxDistance > 0 {
+		filter["mindistance"] = bson.M{"$lte": query.MaxDistance}
+	}
+	if query.Venue != "" {
+		filter["venue"] = query.Venue
+	}
+
+	cursor, err := r.col.Find(
+		context.Background(),
+		filter,
+		options.Find().
+			SetSort(bson.D{{Key: "startTime", Value: 1}, {Key: "_id", Value: 1}}).
+			SetSkip(query.Offset).
+			SetLimit(query.Limit),
+	)
+	if err != nil {
+		return
+	}
+
+	contacts = []ContactEvent{}
+	err = cursor.All(context.Background(), &contacts)
+	return
+}
+
+// bucketSizeFilter matches the records stored with time buckets of size,
+// including the records stored without a size when it is TimeBucketSize
+func bucketSizeFilter(size int64) interface{} {
+	if bucketSizeOf(size) == TimeBucketSize {
+		return bson.M{"$in": bson.A{nil, TimeBucketSize}}
+	}
+	return size
 }
@@ -0,0 +1,190 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrVenueRequired is returned by Reprocess when no venue is given
+var ErrVenueRequired = errors.New("a venue is required")
+
+// RangeCounts counts the records of a venue in a range of time buckets
+type RangeCounts struct {
+	PositionEvents   int64 `json:"positionEvents"`
+	MinuteAggregates int64 `json:"minuteAggregates"`
+	ContactEvents    int64 `json:"contactEvents"`
+}
+
+// ReprocessConfig defines configuration values for Reprocess
+type ReprocessConfig struct {
+	Store  Store
+	Venues venue.Configs
+	Rule   DistanceRule
+	MaxGap time.Duration
+	Venue  string
+	// From and To are the first and last time buckets of TimeBucketSize
+	// to reprocess
+	From uint32
+	To   uint32
+	// DryRun only counts what would be reprocessed
+	DryRun bool
+	// Progress, when set, is called after every time bucket
+	Progress func(report ReprocessReport)
+}
+
+// ReprocessReport describes the progress of Reprocess
+type ReprocessReport struct {
+	Venue string `json:"venue"`
+	// BucketSize is the time bucket size of the venue in milliseconds
+	BucketSize int64 `json:"bucketSize"`
+	// From and To are the range of time buckets of BucketSize reprocessed,
+	// which is widened from the requested range to cover whole contact events
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+	// Found is what the range held before reprocessing and Deleted the
+	// derived records that were deleted
+	Found   RangeCounts `json:"found"`
+	Deleted RangeCounts `json:"deleted"`
+	// TimeBucket is the last time bucket reprocessed
+	TimeBucket       uint32 `json:"timeBucket"`
+	PositionEvents   int64  `json:"positionEvents"`
+	MinuteAggregates int64  `json:"minuteAggregates"`
+	DryRun           bool   `json:"dryRun"`
+}
+
+// Reprocess recomputes the minute aggregates, contact events and daily
+// exposures of a venue over a range of time buckets with the current
+// venue configuration and distance rule. It deletes the derived records
+// of the range then runs the stored position events through the same
+// steps as the EventWorkers and AggregateWorkers, a time bucket at a time
+// in order.
+//
+// Only the records with the time bucket size currently configured for the
+// venue are reprocessed, so records stored before the venue changed its
+// time bucket size are left as they are.
+//
+// The range is first widened until no contact event of the venue is only
+// partly within it, so no contact loses the minutes outside the range.
+// Reprocessing the same range again gives the same result, so a run that
+// fails part way through can simply be started over. Ranges still
+// receiving position events shouldn't be reprocessed.
+func Reprocess(c ReprocessConfig) (report ReprocessReport, err error) {
+	if c.Venue == "" {
+		return report, ErrVenueRequired
+	}
+
+	report.Venue = c.Venue
+	report.DryRun = c.DryRun
+	report.BucketSize = bucketSizeOf(c.Venues.For(c.Venue).TimeBucketSize)
+	from, to := bucketRange(c.From, c.To, report.BucketSize)
+	report.From, report.To, err = widenRange(c.Store, c.Venue, report.BucketSize, from, to)
+	if err != nil {
+		return
+	}
+
+	report.Found, err = c.Store.CountVenueRange(c.Venue, report.BucketSize, report.From, report.To)
+	if err != nil || c.DryRun {
+		return
+	}
+
+	report.Deleted, err = c.Store.DeleteDerived(c.Venue, report.BucketSize, report.From, report.To)
+	if err != nil {
+		return
+	}
+
+	config := c.Venues.For(c.Venue)
+	m := matcher{store: c.Store, venues: c.Venues, rule: c.Rule}
+	for bucket := report.From; bucket <= report.To; bucket++ {
+		events, err := c.Store.FindVenueEvents(c.Venue, report.BucketSize, bucket)
+		if err != nil {
+			return report, err
+		}
+
+		for _, event := range events {
+			minuteAggregates, err := m.match(event)
+			if err != nil {
+				return report, err
+			}
+			for _, minuteAggregate := range minuteAggregates {
+				// reprocessing isn't late data so no contact event is closed
+				if err := mergeMinuteAggregate(c.Store, minuteAggregate, c.MaxGap, 0); err != nil {
+					return report, err
+				}
+			}
+			// the zones may have changed since the event was tagged
+			event.Zone = zoneOf(config, event)
+			if err := recordOccupancy(c.Store, config, event); err != nil {
+				return report, err
+			}
+			if err := c.Store.AckEvent(event.ID); err != nil {
+				return report, err
+			}
+
+			report.PositionEvents++
+			report.MinuteAggregates += int64(len(minuteAggregates))
+		}
+
+		report.TimeBucket = bucket
+		if c.Progress != nil {
+			c.Progress(report)
+		}
+	}
+
+	return report, nil
+}
+
+// widenRange extends [from, to] until every contact event of venue
+// overlapping it is entirely within it
+func widenRange(store Store, venue string, bucketSize int64, from uint32, to uint32) (uint32, uint32, error) {
+	for {
+		contacts, err := store.FindVenueContacts(venue, bucketSize, from, to)
+		if err != nil {
+			return from, to, err
+		}
+
+		widened := false
+		for _, contact := range contacts {
+			if contact.Start < from {
+				from = contact.Start
+				widened = true
+			}
+			if contact.End > to {
+				to = contact.End
+				widened = true
+			}
+		}
+		if !widened {
+			return from, to, nil
+		}
+	}
+}
+
+// mergedExposures sums the minute aggregates in merged into the
+// DailyExposure of their devices each would have been added to
+func mergedExposures(minAggregates []MinuteAggregate, merged map[primitive.ObjectID]bool) []DailyExposure {
+	var exposures []DailyExposure
+	index := map[string]int{}
+	for _, minAggregate := range minAggregates {
+		if !merged[minAggregate.ID] {
+			continue
+		}
+
+		devices := [2]string{minAggregate.Events[0].DeviceID, minAggregate.Events[1].DeviceID}
+		day := dayOf(minAggregate.TimeBucket, minAggregate.BucketSize)
+		key := fmt.Sprintf("%s/%s/%d", devices[0], devices[1], day)
+		i, ok := index[key]
+		if !ok {
+			i = len(exposures)
+			index[key] = i
+			exposures = append(exposures, DailyExposure{Devices: devices, Day: day})
+		}
+		minutes := bucketMinutes(minAggregate.BucketSize)
+		exposures[i].Minutes += minutes
+		exposures[i].ExposureMinutes += minAggregate.Probability * minutes
+	}
+	return exposures
+}
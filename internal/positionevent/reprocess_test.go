@@ -0,0 +1,130 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"contact-monitoring-ingest-api/pkg/geo"
+	"testing"
+)
+
+// storeContact runs a contact between a and b from minute 100 to 104
+// through the pipeline
+func storeContact(t *testing.T, store Store) {
+	a := geo.Coord{43.482928, -80.535819}
+	b := geo.Coord{43.482889, -80.535771}
+
+	var batches [][]PositionEvent
+	for minute := int64(100); minute < 105; minute++ {
+		batches = append(batches, []PositionEvent{newEvent("a", minute, a)})
+		batches = append(batches, []PositionEvent{newEvent("b", minute, b)})
+	}
+	runPipeline(t, store, batches...)
+}
+
+func reprocess(t *testing.T, store Store, contactDistance float64, from uint32, to uint32, dryRun bool) ReprocessReport {
+	report, err := Reprocess(ReprocessConfig{
+		Store: store,
+		Venues: venue.Fixed(venue.Config{
+			AccuracyThreshold: 5,
+			ContactDistance:   contactDistance,
+			TimeBucketSize:    TimeBucketSize,
+		}),
+		Rule:   AccuracyWeightedRule,
+		Venue:  "venue",
+		From:   from,
+		To:     to,
+		DryRun: dryRun,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestReprocessDryRunOnlyCounts(t *testing.T) {
+	store := NewMemoryStore()
+	storeContact(t, store)
+
+	report := reprocess(t, store, 1, 102, 102, true)
+
+	if report.From != 100 || report.To != 104 {
+		t.Errorf("expected the range to widen to the contact from 100 to 104 but got %d to %d", report.From, report.To)
+	}
+	expected := RangeCounts{PositionEvents: 10, MinuteAggregates: 5, ContactEvents: 1}
+	if report.Found != expected {
+		t.Errorf("expected to find %v but got %v", expected, report.Found)
+	}
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 || len(store.MinuteAggregates()) != 5 {
+		t.Errorf("expected a dry run to keep the contact and minute aggregates but got %v", contacts)
+	}
+}
+
+func TestReprocessAppliesNewConfiguration(t *testing.T) {
+	store := NewMemoryStore()
+	storeContact(t, store)
+
+	// the devices are about 6m apart with 2m accuracy, too far apart for 1m
+	report := reprocess(t, store, 1, 102, 102, false)
+
+	if report.Deleted.MinuteAggregates != 5 || report.Deleted.ContactEvents != 1 {
+		t.Errorf("expected 5 minute aggregates and 1 contact to be deleted but got %v", report.Deleted)
+	}
+	if report.PositionEvents != 10 || report.MinuteAggregates != 0 {
+		t.Errorf("expected 10 events reprocessed into no minute aggregates but got %v", report)
+	}
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 0 {
+		t.Errorf("expected no contacts but got %v", contacts)
+	}
+	exposures, _ := store.FindDaily(DailyExposureQuery{Device: "a", From: 0, To: 1})
+	if len(exposures) != 0 {
+		t.Errorf("expected no daily exposure but got %v", exposures)
+	}
+
+	// without the contact the range doesn't widen, so the whole of it has
+	// to be given. Reprocessing is repeatable, and back at 5m the contact
+	// is restored.
+	for i := 0; i < 2; i++ {
+		reprocess(t, store, 5, 100, 104, false)
+	}
+
+	contacts, _ = store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 || contacts[0].Start != 100 || contacts[0].End != 104 || contacts[0].Duration != 5 {
+		t.Errorf("expected 1 contact from 100 to 104 lasting 5 but got %v", contacts)
+	}
+	exposures, _ = store.FindDaily(DailyExposureQuery{Device: "a", From: 0, To: 1})
+	if len(exposures) != 1 || exposures[0].Minutes != 5 {
+		t.Errorf("expected 5 minutes of daily exposure but got %v", exposures)
+	}
+}
+
+func TestReprocessTagsZonesAgain(t *testing.T) {
+	store := NewMemoryStore()
+
+	// tagged before the east zone was drawn where the event is
+	event := newEvent("a", 100, geo.Coord{0.5, 0.5})
+	event.TimeBucket = 100
+	event.BucketSize = TimeBucketSize
+	event.Zone = "west"
+	if _, err := store.InsertEvent(event); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Reprocess(ReprocessConfig{
+		Store:  store,
+		Venues: venue.Fixed(zonedVenue),
+		Rule:   AccuracyWeightedRule,
+		Venue:  "venue",
+		From:   100,
+		To:     100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	occupancies, _ := store.FindOccupancy(OccupancyQuery{Venue: "venue", BucketSize: TimeBucketSize, From: 100, To: 100})
+	if len(occupancies) != 1 || occupancies[0].Zone != "east" {
+		t.Errorf("expected a in the east zone but got %v", occupancies)
+	}
+}
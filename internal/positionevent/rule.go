@@ -0,0 +1,99 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"contact-monitoring-ingest-api/pkg/geo"
+	"fmt"
+	"math"
+)
+
+// DistanceRule decides whether two position events in the same time
+// bucket are close enough for their devices to be in contact
+type DistanceRule string
+
+const (
+	// FixedRule matches events whose reported positions are within
+	// the contact distance, ignoring accuracy
+	FixedRule DistanceRule = "fixed"
+	// AccuracyWeightedRule matches events whose accuracy circles come
+	// within the contact distance of each other
+	AccuracyWeightedRule DistanceRule = "accuracy-weighted"
+	// OverlapRule matches events when enough of the smaller accuracy circle,
+	// each widened by half the contact distance, overlaps the other one
+	OverlapRule DistanceRule = "overlap"
+	// GaussianRule matches events when the devices were likely within the
+	// contact distance, treating each position as a 2D Gaussian; see
+	// ContactProbability
+	GaussianRule DistanceRule = "gaussian"
+)
+
+// minCircleOverlap is the fraction of the smaller circle that has to
+// overlap the other one for OverlapRule to match
+const minCircleOverlap = 0.5
+
+// minContactProbability is the ContactProbability at which GaussianRule matches
+const minContactProbability = 0.5
+
+// ParseDistanceRule returns the DistanceRule named by rule. An empty
+// rule is AccuracyWeightedRule, which is how contacts were always matched.
+func ParseDistanceRule(rule string) (DistanceRule, error) {
+	switch DistanceRule(rule) {
+	case "":
+		return AccuracyWeightedRule, nil
+	case FixedRule, AccuracyWeightedRule, OverlapRule, GaussianRule:
+		return DistanceRule(rule), nil
+	}
+	return "", fmt.Errorf("unknown distance rule %q; use %s, %s, %s or %s", rule, FixedRule, AccuracyWeightedRule, OverlapRule, GaussianRule)
+}
+
+// Radius returns how far in meters from event to look for events the rule
+// could match, given that their accuracy is at most config.AccuracyThreshold
+func (r DistanceRule) Radius(event PositionEvent, config venue.Config) float64 {
+	switch r {
+	case FixedRule:
+		return config.ContactDistance
+	case GaussianRule:
+		// the accuracy circles only hold about two thirds of the probability
+		// so look well beyond them
+		return config.ContactDistance + 2*(float64(event.Accuracy)+config.AccuracyThreshold)
+	}
+	return float64(event.Accuracy) + config.ContactDistance + config.AccuracyThreshold
+}
+
+// Match returns whether two events distance meters apart with accuracies
+// accA and accB are in contact, and a score between 0 and 1 of how much
+// the rule supports the contact
+func (r DistanceRule) Match(distance float64, accA float64, accB float64, contactDistance float64) (matched bool, score float64) {
+	switch r {
+	case FixedRule:
+		matched = distance <= contactDistance
+	case GaussianRule:
+		score = ContactProbability(distance, accA, accB, contactDistance)
+		return score >= minContactProbability, score
+	case OverlapRule:
+		rA := accA + contactDistance/2
+		rB := accB + contactDistance/2
+		smaller := math.Min(rA, rB)
+		if smaller == 0 {
+			matched = distance == 0
+		} else {
+			score = geo.CircleIntersectionArea(distance, rA, rB) / (math.Pi * smaller * smaller)
+			return score >= minCircleOverlap, score
+		}
+	default:
+		matched = distance < accA+accB+contactDistance
+	}
+
+	if matched {
+		score = 1
+	}
+	return matched, score
+}
+
+// ContactProbability returns the probability that the devices of two events
+// distance meters apart with accuracies accA and accB were actually within
+// contactDistance of each other, treating each reported position and
+// accuracy as a circular 2D Gaussian
+func ContactProbability(distance float64, accA float64, accB float64, contactDistance float64) float64 {
+	return geo.ProbabilityWithin(distance, geo.AccuracySigma(accA), geo.AccuracySigma(accB), contactDistance)
+}
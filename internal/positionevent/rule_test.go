@@ -0,0 +1,134 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/internal/venue"
+	"contact-monitoring-ingest-api/pkg/geo"
+	"fmt"
+	"testing"
+)
+
+var matchTests = []struct {
+	rule       DistanceRule
+	distance   float64
+	accA, accB float64
+	matched    bool
+}{
+	{rule: FixedRule, distance: 2, accA: 10, accB: 10, matched: true},
+	{rule: FixedRule, distance: 3, accA: 10, accB: 10, matched: false},
+	{rule: AccuracyWeightedRule, distance: 3, accA: 1, accB: 1, matched: true},
+	{rule: AccuracyWeightedRule, distance: 4, accA: 1, accB: 1, matched: false},
+	// identical circles half a radius apart overlap by about 69%
+	{rule: OverlapRule, distance: 1, accA: 1, accB: 1, matched: true},
+	// identical circles a radius apart overlap by about 39%
+	{rule: OverlapRule, distance: 2, accA: 1, accB: 1, matched: false},
+	// a precise position inside a vague one overlaps entirely
+	{rule: OverlapRule, distance: 5, accA: 10, accB: 0, matched: true},
+	{rule: GaussianRule, distance: 0, accA: 1, accB: 1, matched: true},
+	// poor accuracy makes a contact within 2m unlikely even though the
+	// accuracy circles come within 2m of each other
+	{rule: AccuracyWeightedRule, distance: 9, accA: 5, accB: 5, matched: true},
+	{rule: GaussianRule, distance: 9, accA: 5, accB: 5, matched: false},
+}
+
+func TestDistanceRuleMatch(t *testing.T) {
+	for _, tt := range matchTests {
+		t.Run(fmt.Sprintf("%s d=%v acc=%v,%v", tt.rule, tt.distance, tt.accA, tt.accB), func(t *testing.T) {
+			matched, score := tt.rule.Match(tt.distance, tt.accA, tt.accB, 2)
+
+			if matched != tt.matched {
+				t.Errorf("expected matched %v but got %v with score %v", tt.matched, matched, score)
+			}
+			if score < 0 || score > 1 {
+				t.Errorf("expected a score between 0 and 1 but got %v", score)
+			}
+		})
+	}
+}
+
+func TestParseDistanceRule(t *testing.T) {
+	rule, err := ParseDistanceRule("")
+	if err != nil || rule != AccuracyWeightedRule {
+		t.Errorf("expected %s by default but got %q, %v", AccuracyWeightedRule, rule, err)
+	}
+
+	if _, err := ParseDistanceRule("nearest"); err == nil {
+		t.Error("expected an error for an unknown rule")
+	}
+}
+
+func TestMatchAcrossOpenFloors(t *testing.T) {
+	store := NewMemoryStore()
+	venues := venue.Fixed(venue.Config{
+		ContactDistance: 2,
+		TimeBucketSize:  TimeBucketSize,
+		Floors: &venue.FloorModel{
+			Height:     4,
+			Elevations: []venue.FloorElevation{{Floor: 1, Elevation: 1}},
+			Open:       [][]int16{{0, 1}},
+		},
+	})
+
+	lonlat := geo.Coord{-80.535819, 43.482928}
+	for device, floor := range map[string]int16{"b": 1, "c": 2} {
+		event := newEvent(device, 0, lonlat)
+		event.Floor = floor
+		if _, err := store.InsertEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	event := newEvent("a", 0, lonlat)
+	id, err := store.InsertEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.ID = id
+
+	minuteAggregates, err := matcher{store: store, venues: venues, rule: FixedRule}.match(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minuteAggregates) != 1 {
+		t.Fatalf("expected 1 minute aggregate but got %d", len(minuteAggregates))
+	}
+	if m := minuteAggregates[0]; m.Events[1].DeviceID != "b" || m.Distance != 1 {
+		t.Errorf("expected a contact with b on the mezzanine 1m away but got %+v", m)
+	}
+}
+
+func TestMatchSkipsEventsAcrossAWall(t *testing.T) {
+	store := NewMemoryStore()
+	a, b := geo.Coord{-80.535819, 43.482928}, geo.Coord{-80.535800, 43.482928}
+	wall := venue.PlanFeature{
+		Type: "Feature",
+		Geometry: venue.PlanGeometry{
+			Type:  "LineString",
+			Lines: [][]geo.Coord{{{-80.535810, 43.482900}, {-80.535810, 43.482950}}},
+		},
+	}
+	venues := venue.Fixed(venue.Config{
+		ContactDistance: 2,
+		TimeBucketSize:  TimeBucketSize,
+		Floors: &venue.FloorModel{
+			Plans: []venue.FloorPlan{{Type: "FeatureCollection", Features: []venue.PlanFeature{wall}}},
+		},
+	})
+
+	if _, err := store.InsertEvent(newEvent("b", 0, b)); err != nil {
+		t.Fatal(err)
+	}
+	event := newEvent("a", 0, a)
+	id, err := store.InsertEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.ID = id
+
+	minuteAggregates, err := matcher{store: store, venues: venues, rule: FixedRule}.match(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minuteAggregates) != 0 {
+		t.Errorf("expected no minute aggregates across the wall but got %+v", minuteAggregates)
+	}
+}
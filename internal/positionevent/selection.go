@@ -0,0 +1,131 @@
+package positionevent
+
+import (
+	"fmt"
+	"math"
+)
+
+// SelectionStrategy decides which of the positions a device sends for the
+// same time bucket is processed
+type SelectionStrategy string
+
+const (
+	// FirstSelection processes the earliest position of a time bucket
+	// and turns the rest away, which is how positions were always selected
+	FirstSelection SelectionStrategy = "first"
+	// AccuracySelection processes the position with the best accuracy
+	AccuracySelection SelectionStrategy = "accuracy"
+	// MidpointSelection processes the position nearest to the middle of
+	// the time bucket
+	MidpointSelection SelectionStrategy = "midpoint"
+	// CentroidSelection processes the centroid of the positions on the
+	// floor of the most accurate one, weighted by the inverse of the
+	// square of their accuracy as independent measurements would be
+	CentroidSelection SelectionStrategy = "centroid"
+)
+
+// minCentroidAccuracy keeps positions reporting perfect accuracy from
+// getting an infinite weight in a centroid
+const minCentroidAccuracy = 0.1
+
+// ParseSelectionStrategy returns the SelectionStrategy named by strategy.
+// An empty strategy is FirstSelection.
+func ParseSelectionStrategy(strategy string) (SelectionStrategy, error) {
+	switch SelectionStrategy(strategy) {
+	case "":
+		return FirstSelection, nil
+	case FirstSelection, AccuracySelection, MidpointSelection, CentroidSelection:
+		return SelectionStrategy(strategy), nil
+	}
+	return "", fmt.Errorf("unknown selection strategy %q; use %s, %s, %s or %s", strategy, FirstSelection, AccuracySelection, MidpointSelection, CentroidSelection)
+}
+
+// replaces reports whether a position selected by the strategy replaces
+// a stored position of lower quality in the same time bucket, rather
+// than being turned away as the first one always wins
+func (s SelectionStrategy) replaces() bool {
+	return s != "" && s != FirstSelection
+}
+
+// quality scores event from 0 to 1 so that a position of higher quality
+// is the one the strategy would select
+func (s SelectionStrategy) quality(event PositionEvent) float64 {
+	switch s {
+	case MidpointSelection:
+		midpoint := int64(event.TimeBucket)*bucketSizeOf(event.BucketSize) + bucketSizeOf(event.BucketSize)/2
+		return 1 / (1 + math.Abs(float64(event.Time-midpoint))/1000)
+	case AccuracySelection, CentroidSelection:
+		return 1 / (1 + float64(event.Accuracy))
+	}
+	return 0
+}
+
+// selectEvent returns the event to process of the events of a time bucket,
+// sorted by time, and the indexes of the events it was selected from: the
+// one it is, or the ones its centroid combines
+func (s SelectionStrategy) selectEvent(events []PositionEvent) (used []int, event PositionEvent) {
+	switch s {
+	case AccuracySelection, MidpointSelection:
+		selected := 0
+		for i := range events {
+			if s.quality(events[i]) > s.quality(events[selected]) {
+				selected = i
+			}
+		}
+		return []int{selected}, events[selected]
+	case CentroidSelection:
+		if len(events) == 1 {
+			return []int{0}, events[0]
+		}
+		return centroid(events)
+	}
+	return []int{0}, events[0]
+}
+
+// centroid combines the events on the floor of the most accurate of them
+// into one at their centroid weighted by the inverse of the square of
+// their accuracy, with the accuracy of the weighted mean. It returns the
+// indexes of the events it combined.
+func centroid(events []PositionEvent) (used []int, combined PositionEvent) {
+	best := events[0]
+	for _, event := range events {
+		if event.Accuracy < best.Accuracy {
+			best = event
+		}
+	}
+
+	combined = best
+	combined.LonLat[0], combined.LonLat[1] = 0, 0
+	var total, sumTime float64
+	for i, event := range events {
+		if event.Floor != best.Floor {
+			continue
+		}
+		used = append(used, i)
+		accuracy := math.Max(float64(event.Accuracy), minCentroidAccuracy)
+		weight := 1 / (accuracy * accuracy)
+		total += weight
+		combined.LonLat[0] += weight * event.LonLat[0]
+		combined.LonLat[1] += weight * event.LonLat[1]
+		sumTime += weight * float64(event.Time)
+		combined.UserConsent = combined.UserConsent && event.UserConsent
+	}
+
+	combined.LonLat[0] /= total
+	combined.LonLat[1] /= total
+	combined.Time = int64(math.Round(sumTime / total))
+	combined.Accuracy = float32(1 / math.Sqrt(total))
+	if combined.RawTime != 0 {
+		combined.RawTime = combined.Time + combined.ClockOffset
+	}
+	return used, combined
+}
+
+func containsIndex(indexes []int, index int) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package positionevent
+
+import (
+	"contact-monitoring-ingest-api/pkg/geo"
+	"math"
+	"testing"
+)
+
+// bucketSamples are three positions of a device in minute 100, the
+// first at its start, the second at its middle and the last the most
+// accurate
+func bucketSamples() []PositionEvent {
+	samples := []PositionEvent{
+		newEvent("a", 100, geo.Coord{43.4829, -80.5358}),
+		newEvent("a", 100, geo.Coord{43.4829, -80.5358}),
+		newEvent("a", 100, geo.Coord{43.4830, -80.5357}),
+	}
+	samples[0].Accuracy = 4
+	samples[1].Time = 100*TimeBucketSize + TimeBucketSize/2
+	samples[1].Accuracy = 4
+	samples[2].Time = 100*TimeBucketSize + 50*1000
+	samples[2].Accuracy = 2
+	for i := range samples {
+		samples[i].TimeBucket = 100
+	}
+	return samples
+}
+
+func TestSelectionStrategySelectEvent(t *testing.T) {
+	tests := []struct {
+		strategy SelectionStrategy
+		selected int
+	}{
+		{strategy: FirstSelection, selected: 0},
+		{strategy: AccuracySelection, selected: 2},
+		{strategy: MidpointSelection, selected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			if used, _ := tt.strategy.selectEvent(bucketSamples()); len(used) != 1 || used[0] != tt.selected {
+				t.Errorf("expected sample %d to be selected but got %v", tt.selected, used)
+			}
+		})
+	}
+}
+
+func TestCentroidWeightsByAccuracy(t *testing.T) {
+	used, event := CentroidSelection.selectEvent(bucketSamples())
+	if len(used) != 3 {
+		t.Fatalf("expected a centroid of every sample but got %v", used)
+	}
+
+	// the last sample weighs 4 times the others so it has 2/3 of the weight
+	if math.Abs(event.LonLat[0]-(43.4829+2*43.4830)/3) > 1e-9 || math.Abs(event.LonLat[1]-(-80.5358+2*-80.5357)/3) > 1e-9 {
+		t.Errorf("expected the centroid two thirds of the way to the last sample but got %v", event.LonLat)
+	}
+	// the combined accuracy is better than any one sample
+	if math.Abs(float64(event.Accuracy)-math.Sqrt(8.0/3)) > 1e-6 {
+		t.Errorf("expected accuracy %v but got %v", math.Sqrt(8.0/3), event.Accuracy)
+	}
+	if event.TimeBucket != 100 || event.Time/TimeBucketSize != 100 {
+		t.Errorf("expected the centroid to stay in minute 100 but got %v", event.Time)
+	}
+}
+
+func TestCentroidLeavesOutOtherFloors(t *testing.T) {
+	samples := bucketSamples()
+	samples[1].Floor = 1
+
+	used, event := CentroidSelection.selectEvent(samples)
+	if len(used) != 2 || used[0] != 0 || used[1] != 2 {
+		t.Fatalf("expected a centroid of samples 0 and 2 but got %v", used)
+	}
+	if event.Floor != 0 {
+		t.Errorf("expected the centroid on the floor of the last sample but got %d", event.Floor)
+	}
+}
+
+func TestParseSelectionStrategy(t *testing.T) {
+	if strategy, err := ParseSelectionStrategy(""); err != nil || strategy != FirstSelection {
+		t.Errorf("expected an empty strategy to be first but got %v, %v", strategy, err)
+	}
+	if _, err := ParseSelectionStrategy("latest"); err == nil {
+		t.Error("expected an unknown strategy to fail")
+	}
+}
@@ -0,0 +1,135 @@
+package positionevent
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrDuplicate is returned by a Store when a write collides with an
+// existing record, eg. a second position for a device in a time bucket
+var ErrDuplicate = errors.New("duplicate record")
+
+// Store is an interface for the persistence the ingest pipeline needs:
+// storing position events, finding events near one another, storing
+// minute aggregates and merging them into contact events.
+//
+// UpsertEvent inserts an event like InsertEvent, except that it replaces
+// the stored event of the device in the time bucket when that one has a
+// lower Quality, or none, or was interpolated. The replaced event keeps
+// its id.
+//
+// ReplaceInterpolatedEvent replaces the stored event of the device in the
+// time bucket of an event when that one was interpolated, and returns
+// ErrDuplicate when it wasn't. The replaced event keeps its id.
+//
+// DeleteEventDerived deletes the minute aggregates derived from a stored
+// event, so they can be derived again after it was replaced, along with
+// the contact events they were merged into, taking those off the
+// DailyExposure of their devices. It returns the other minute aggregates
+// of the deleted contact events, which are left pending to be merged again.
+// It either deletes all of that or nothing.
+//
+// LastEvent returns the latest event of a device with time buckets of
+// bucketSize before the time bucket before, or nil when there is none.
+//
+// Events and minute aggregates are inserted with Pending set and stay
+// pending until acknowledged, which makes the store double as a durable
+// queue between the stages of the pipeline; see Replay.
+//
+// MergeContact merges a contact event of a single minute aggregate into
+// the contact events of the same devices and time bucket size that end or
+// start within maxGap time buckets of it, and adds it to their
+// DailyExposure. Merging the same minute aggregate again, or one that was
+// deleted by DeleteEventDerived, is a no-op. When any of the contact
+// events it replaces ended before closedBefore, a ContactChange is
+// recorded.
+//
+// RecordOccupancy adds the device of an event to the ZoneOccupancy of its
+// zone and time bucket, and removes it from the other zones of the venue
+// in that time bucket. Recording the same event again is a no-op.
+//
+// AcquireLease acquires the named lease, or renews it, for holder until
+// ttl from now. It reports false when another holder has the lease and it
+// hasn't expired yet.
+//
+// The venue methods select the records of a venue in a range of time
+// buckets of bucketSize for Reprocess. Contact events are selected when
+// any part of them falls within the range.
+type Store interface {
+	ContactRepo
+	ExposureRepo
+	ChangeRepo
+	OccupancyRepo
+	InsertEvent(event PositionEvent) (id primitive.ObjectID, err error)
+	UpsertEvent(event PositionEvent) (id primitive.ObjectID, replaced bool, err error)
+	ReplaceInterpolatedEvent(event PositionEvent) (id primitive.ObjectID, err error)
+	DeleteEvent(id primitive.ObjectID) (err error)
+	DeleteEventDerived(event PositionEvent) (remerge []MinuteAggregate, err error)
+	FindNearby(event PositionEvent, floors []int16, radius float64) (events []PositionEvent, err error)
+	LastEvent(device string, bucketSize int64, before uint32) (event *PositionEvent, err error)
+	AckEvent(id primitive.ObjectID) (err error)
+	PendingEvents(after primitive.ObjectID, before primitive.ObjectID, limit int64) (events []PositionEvent, err error)
+	InsertMinuteAggregate(minAggregate MinuteAggregate) (id primitive.ObjectID, err error)
+	AckMinuteAggregate(id primitive.ObjectID) (err error)
+	PendingMinuteAggregates(after primitive.ObjectID, before primitive.ObjectID, limit int64) (minAggregates []MinuteAggregate, err error)
+	MergeContact(contact ContactEvent, maxGap uint32, closedBefore uint32) (merged ContactEvent, err error)
+	RecordOccupancy(event PositionEvent) (err error)
+	AcquireLease(name string, holder string, ttl time.Duration) (acquired bool, err error)
+	FindVenueEvents(venue string, bucketSize int64, timeBucket uint32) (events []PositionEvent, err error)
+	FindVenueContacts(venue string, bucketSize int64, from uint32, to uint32) (contacts []ContactEvent, err error)
+	CountVenueRange(venue string, bucketSize int64, from uint32, to uint32) (counts RangeCounts, err error)
+	DeleteDerived(venue string, bucketSize int64, from uint32, to uint32) (deleted RangeCounts, err error)
+}
+
+// mergeContacts combines a contact event with the contact events of the
+// same devices that are within the gap tolerance before or after it
+func mergeContacts(contact ContactEvent, neighbours []ContactEvent) ContactEvent {
+	sort.Slice(neighbours, func(i, j int) bool {
+		return neighbours[i].Start < neighbours[j].Start
+	})
+
+	var minuteAggregates []primitive.ObjectID
+	added := false
+	for _, neighbour := range neighbours {
+		if !added && neighbour.Start > contact.Start {
+			minuteAggregates = append(minuteAggregates, contact.MinuteAggregates...)
+			added = true
+		}
+		minuteAggregates = append(minuteAggregates, neighbour.MinuteAggregates...)
+
+		if neighbour.Start < contact.Start {
+			contact.Start = neighbour.Start
+			contact.FirstContact = neighbour.FirstContact
+		}
+		if neighbour.End > contact.End {
+			contact.End = neighbour.End
+		}
+		contact.Duration = contact.Duration + neighbour.Duration
+		contact.ExposureMinutes = contact.ExposureMinutes + neighbour.ExposureMinutes
+		if neighbour.MinDistance < contact.MinDistance {
+			contact.MinDistance = neighbour.MinDistance
+		}
+		if neighbour.MaxDistance > contact.MaxDistance {
+			contact.MaxDistance = neighbour.MaxDistance
+		}
+	}
+	if !added {
+		minuteAggregates = append(minuteAggregates, contact.MinuteAggregates...)
+	}
+	contact.MinuteAggregates = minuteAggregates
+	contact.StartTime = int64(contact.Start) * bucketSizeOf(contact.BucketSize)
+
+	return contact
+}
+
+// mergeWindow returns the range of time buckets a contact event of the
+// same devices has to overlap to be merged with contact
+func mergeWindow(contact ContactEvent, maxGap uint32) (from uint32, to uint32) {
+	if contact.Start > maxGap+1 {
+		from = contact.Start - maxGap - 1
+	}
+	return from, contact.End + maxGap + 1
+}
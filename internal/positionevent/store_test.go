@@ -0,0 +1,263 @@
+package positionevent
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// minuteContact stores the minute aggregate of a contact event in bucket
+// since merging one that isn't stored is a no-op
+func minuteContact(store Store, bucket uint32, probability float64) ContactEvent {
+	id, _ := store.InsertMinuteAggregate(MinuteAggregate{
+		TimeBucket:  bucket,
+		Events:      [2]PartialPositionEvent{{DeviceID: "a"}, {DeviceID: "b"}},
+		Probability: probability,
+		Venue:       "venue",
+	})
+	return ContactEvent{
+		Devices:          [2]string{"a", "b"},
+		Start:            bucket,
+		End:              bucket,
+		MinuteAggregates: []primitive.ObjectID{id},
+		Duration:         1,
+		ExposureMinutes:  probability,
+		Venue:            "venue",
+	}
+}
+
+func TestMergeContactWithinGapTolerance(t *testing.T) {
+	store := NewMemoryStore()
+
+	// minutes 100 and 101, then 104 after missing 2 minutes, then 108 after missing 3
+	for _, bucket := range []uint32{100, 101, 104, 108} {
+		if _, err := store.MergeContact(minuteContact(store, bucket, 0.5), 2, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 2 {
+		t.Fatalf("expected 2 contacts but got %d: %v", len(contacts), contacts)
+	}
+	if contacts[0].Start != 100 || contacts[0].End != 104 || contacts[0].Duration != 3 {
+		t.Errorf("expected contact from 100 to 104 lasting 3 but got %v", contacts[0])
+	}
+	if contacts[0].ExposureMinutes != 1.5 {
+		t.Errorf("expected 1.5 exposure minutes but got %v", contacts[0].ExposureMinutes)
+	}
+	if contacts[1].Start != 108 || contacts[1].End != 108 {
+		t.Errorf("expected contact at 108 but got %v", contacts[1])
+	}
+}
+
+func TestMergeContactFillsGap(t *testing.T) {
+	store := NewMemoryStore()
+
+	for _, bucket := range []uint32{100, 103, 101} {
+		if _, err := store.MergeContact(minuteContact(store, bucket, 1), 2, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 1 || contacts[0].Start != 100 || contacts[0].End != 103 || contacts[0].Duration != 3 {
+		t.Errorf("expected 1 contact from 100 to 103 lasting 3 but got %v", contacts)
+	}
+}
+
+func TestMergeContactAddsDailyExposureOnce(t *testing.T) {
+	store := NewMemoryStore()
+
+	// three 10 minute episodes on one day and one minute the next day
+	var first ContactEvent
+	for episode := uint32(0); episode < 3; episode++ {
+		for minute := uint32(0); minute < 10; minute++ {
+			contact := minuteContact(store, bucketsPerDay*10+episode*120+minute, 1)
+			if episode == 0 && minute == 0 {
+				first = contact
+			}
+			if _, err := store.MergeContact(contact, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := store.MergeContact(minuteContact(store, bucketsPerDay*11, 1), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// replaying a minute aggregate doesn't count it again
+	if _, err := store.MergeContact(first, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	exposures, _ := store.FindDaily(DailyExposureQuery{Device: "b", From: 10, To: 11, MinMinutes: 15})
+	if len(exposures) != 1 {
+		t.Fatalf("expected 1 day with at least 15 minutes but got %v", exposures)
+	}
+	if exposures[0].Day != 10 || exposures[0].Minutes != 30 || exposures[0].ExposureMinutes != 30 {
+		t.Errorf("expected 30 minutes on day 10 but got %v", exposures[0])
+	}
+	if exposures[0].Start != bucketsPerDay*10 || len(exposures[0].Venues) != 1 {
+		t.Errorf("expected day 10 to start at %d at 1 venue but got %v", bucketsPerDay*10, exposures[0])
+	}
+}
+
+func TestMergeContactRecordsChangeToClosedContact(t *testing.T) {
+	store := NewMemoryStore()
+
+	for _, bucket := range []uint32{100, 101} {
+		if _, err := store.MergeContact(minuteContact(store, bucket, 1), 2, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the contact ending at 101 is closed by the time 103 arrives late
+	if _, err := store.MergeContact(minuteContact(store, 103, 1), 2, 102); err != nil {
+		t.Fatal(err)
+	}
+	// the contact now ends at 103 so 104 extends an open contact
+	if _, err := store.MergeContact(minuteContact(store, 104, 1), 2, 102); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, _ := store.FindChanges(ContactChangeQuery{})
+	if len(changes) != 1 {
+		t.Fatalf("expected 1 change but got %v", changes)
+	}
+	if changes[0].Seq != 1 || changes[0].TimeBucket != 103 || len(changes[0].Replaced) != 1 {
+		t.Errorf("expected change 1 at 103 replacing 1 contact but got %v", changes[0])
+	}
+	if changes[0].Contact.Start != 100 || changes[0].Contact.End != 103 || changes[0].Contact.Duration != 3 {
+		t.Errorf("expected the changed contact from 100 to 103 lasting 3 but got %v", changes[0].Contact)
+	}
+
+	if after, _ := store.FindChanges(ContactChangeQuery{After: changes[0].Seq}); len(after) != 0 {
+		t.Errorf("expected no changes after the last one but got %v", after)
+	}
+}
+
+func TestMergeContactSkipsDeletedMinuteAggregate(t *testing.T) {
+	store := NewMemoryStore()
+
+	event := PositionEvent{DeviceID: "a", TimeBucket: 100}
+	event.ID, _ = store.InsertEvent(event)
+	id, _ := store.InsertMinuteAggregate(MinuteAggregate{
+		TimeBucket:  100,
+		Events:      [2]PartialPositionEvent{{ID: event.ID, DeviceID: "a"}, {DeviceID: "b"}},
+		Probability: 1,
+		Venue:       "venue",
+	})
+	contact := ContactEvent{
+		Devices:          [2]string{"a", "b"},
+		Start:            100,
+		End:              100,
+		MinuteAggregates: []primitive.ObjectID{id},
+		Duration:         1,
+		ExposureMinutes:  1,
+		Venue:            "venue",
+	}
+
+	// an AggregateWorker that picked up the minute aggregate before the
+	// event was replaced merges it after it was deleted
+	if _, err := store.DeleteEventDerived(event); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.MergeContact(contact, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000}); len(contacts) != 0 {
+		t.Errorf("expected no contact of a deleted minute aggregate but got %v", contacts)
+	}
+}
+
+func bucketAggregate(store Store, bucket uint32, bucketSize int64) MinuteAggregate {
+	minAggregate := MinuteAggregate{
+		TimeBucket:  bucket,
+		BucketSize:  bucketSize,
+		Events:      [2]PartialPositionEvent{{DeviceID: "a"}, {DeviceID: "b"}},
+		Probability: 1,
+		Venue:       "venue",
+	}
+	minAggregate.ID, _ = store.InsertMinuteAggregate(minAggregate)
+	return minAggregate
+}
+
+func TestMergeMinuteAggregatesOfSmallerTimeBuckets(t *testing.T) {
+	store := NewMemoryStore()
+
+	// 15 second buckets 400 to 405 are minutes 100 and 101, with a gap
+	// of 30 seconds tolerated between 401 and 404
+	for _, bucket := range []uint32{400, 401, 404, 405} {
+		if err := mergeMinuteAggregate(store, bucketAggregate(store, bucket, 15000), 30*time.Second, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a contact of the same devices at a venue with minute buckets
+	// isn't merged with them
+	if err := mergeMinuteAggregate(store, bucketAggregate(store, 101, 0), 30*time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 101, To: 101})
+	if len(contacts) != 2 {
+		t.Fatalf("expected 2 contacts in minute 101 but got %v", contacts)
+	}
+	for _, contact := range contacts {
+		if contact.BucketSize != 15000 {
+			continue
+		}
+		if contact.Start != 400 || contact.End != 405 || contact.Duration != 1 || contact.ExposureMinutes != 1 {
+			t.Errorf("expected a contact from 400 to 405 lasting a minute but got %v", contact)
+		}
+	}
+
+	if contacts, _ := store.Find(ContactQuery{Device: "a", From: 102, To: 110}); len(contacts) != 0 {
+		t.Errorf("expected no contacts after minute 101 but got %v", contacts)
+	}
+
+	exposures, _ := store.FindDaily(DailyExposureQuery{Device: "a", From: 0, To: 1})
+	if len(exposures) != 1 || exposures[0].Minutes != 2 {
+		t.Errorf("expected 2 minutes of daily exposure but got %v", exposures)
+	}
+}
+
+func TestFindSortsContactsOfDifferentTimeBucketSizesByTime(t *testing.T) {
+	store := NewMemoryStore()
+
+	// minute 100, then 15 second bucket 396 in minute 99
+	for _, minAggregate := range []MinuteAggregate{bucketAggregate(store, 100, 0), bucketAggregate(store, 396, 15000)} {
+		if err := mergeMinuteAggregate(store, minAggregate, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contacts, _ := store.Find(ContactQuery{Device: "a", From: 0, To: 1000})
+	if len(contacts) != 2 || contacts[0].Start != 396 || contacts[1].Start != 100 {
+		t.Errorf("expected the contact in minute 99 before the one in minute 100 but got %v", contacts)
+	}
+}
+
+func TestAcquireLeaseHeldByOneHolderUntilItExpires(t *testing.T) {
+	store := NewMemoryStore()
+
+	if leased, err := store.AcquireLease(ReplayLease, "a", 50*time.Millisecond); err != nil || !leased {
+		t.Fatalf("expected a to acquire the lease but got %v %v", leased, err)
+	}
+	if leased, _ := store.AcquireLease(ReplayLease, "b", time.Minute); leased {
+		t.Error("expected b not to acquire the lease held by a")
+	}
+	if leased, _ := store.AcquireLease(ReplayLease, "a", 50*time.Millisecond); !leased {
+		t.Error("expected a to renew its lease")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if leased, _ := store.AcquireLease(ReplayLease, "b", time.Minute); !leased {
+		t.Error("expected b to acquire the lease once it expired")
+	}
+	if leased, _ := store.AcquireLease(ReplayLease, "a", time.Minute); leased {
+		t.Error("expected a not to get the lease back from b")
+	}
+}
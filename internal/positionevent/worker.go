@@ -1,218 +1,254 @@
 package positionevent
 
 import (
+	"contact-monitoring-ingest-api/internal/venue"
 	"contact-monitoring-ingest-api/pkg/geo"
 	"context"
 	"log"
 	"sync"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const maximumDistanceBetweenDevices = 5 // in meters
-
 // EventWorkerConfig defines configuration values for an EventWorker
 type EventWorkerConfig struct {
-	DB                            *mongo.Database
-	EventChan                     chan PositionEvent
-	MinAggregateChan              chan MinuteAggregate
-	WG                            *sync.WaitGroup
-	MaximumDistanceBetweenDevices float64
-	AccuracyThreshold             float64
-	Name                          int
+	Store  Store
+	Broker Broker
+	// PublishTimeout is how long to wait for the broker to accept a minute
+	// aggregate before leaving it pending for Redeliver
+	PublishTimeout time.Duration
+	WG             *sync.WaitGroup
+	Venues         venue.Configs
+	Rule           DistanceRule
+	Name           int
 }
 
-// EventWorker processes position.Events from an input channel
-// and puts minute aggregate events on output channel
+// EventWorker processes position.Events from the broker, stores the minute
+// aggregates of any nearby events and publishes them to the broker, and
+// records the occupancy of the zone of the event.
+// An event is only acknowledged once all of its minute aggregates and its
+// occupancy are stored, so a failure part way through leaves it pending
+// for Replay.
 func EventWorker(c EventWorkerConfig) {
 	defer c.WG.Done()
 
-	eventCollection := c.DB.Collection("position-event")
-
-	for event := range c.EventChan {
-		query := bson.M{
-			"_id": bson.M{
-				"$ne": event.ID,
-			},
-			"floor": event.Floor,
-			"lonlat": bson.M{
-				"$geoWithin": bson.M{
-					"$centerSphere": bson.A{
-						event.LonLat,
-						(float64(event.Accuracy) + c.MaximumDistanceBetweenDevices + c.AccuracyThreshold) / geo.EarthRadiusMeters,
-					},
-				},
-			},
-			"timeBucket": event.TimeBucket,
+	m := matcher{store: c.Store, venues: c.Venues, rule: c.Rule}
+	for event := range c.Broker.Events() {
+		minuteAggregates, err := m.match(event)
+
+		// the minute aggregates are stored so if the broker doesn't take
+		// them in time they stay pending and are redelivered later rather
+		// than stalling the worker
+		for _, minuteAggregate := range minuteAggregates {
+			if err := c.publish(minuteAggregate); err != nil {
+				minuteAggregatesDeferred.Inc()
+				log.Println("error publishing minute aggregate; deferring", minuteAggregate.ID.Hex(), err)
+			}
 		}
-		cursor, err := eventCollection.Find(context.Background(), query)
 
 		if err != nil {
-			log.Println(err)
+			continue
+		}
+		if err := recordOccupancy(c.Store, c.Venues.For(event.Venue), event); err != nil {
 			continue
 		}
 
-		var results []PositionEvent
-		err = cursor.All(context.Background(), &results)
-		if err != nil {
-			log.Fatal(err)
+		if err := c.Store.AckEvent(event.ID); err != nil {
+			log.Println("error acknowledging position event", err)
 		}
+	}
+}
+
+// matcher finds the events near a position event that the distance rule
+// matches with it, as configured for its venue
+type matcher struct {
+	store  Store
+	venues venue.Configs
+	rule   DistanceRule
+}
 
-		for _, result := range results {
-			distance := geo.Distance(event.LonLat, result.LonLat)
-			if event.ID != result.ID && distance < float64(event.Accuracy+result.Accuracy+5) {
-				events := [2]PartialPositionEvent{
-					{
-						ID:       event.ID,
-						DeviceID: event.DeviceID,
-						Accuracy: event.Accuracy,
-						LonLat:   event.LonLat,
-					},
-					{
-						ID:       result.ID,
-						DeviceID: result.DeviceID,
-						Accuracy: result.Accuracy,
-						LonLat:   result.LonLat,
-					},
-				}
-				if events[0].DeviceID > events[1].DeviceID {
-					events[0], events[1] = events[1], events[0]
-				}
-
-				// normally this would be producing to kafka, but we're imitating with a channel
-				minuteAggregate := MinuteAggregate{
-					TimeBucket: event.TimeBucket,
-					Events:     events,
-					Distance:   distance,
-					Floor:      event.Floor,
-				}
-
-				c.MinAggregateChan <- minuteAggregate
+// match stores a minute aggregate for each event matching event and
+// returns the ones it inserted. Events on floors open to the floor of event
+// are matched too, by their distance in 3D, while events on the same floor
+// that its floor plan separates by a wall or room are not. Minute
+// aggregates already stored by the other event of the pair are skipped.
+// err is set when any of them could not be stored, in which case event
+// should be left pending.
+func (m matcher) match(event PositionEvent) (minuteAggregates []MinuteAggregate, err error) {
+	config := m.venues.For(event.Venue)
+	radius := m.rule.Radius(event, config)
+	queryStart := time.Now()
+	results, err := m.store.FindNearby(event, config.Floors.ContactFloors(event.Floor), radius)
+	nearbyQueryDuration.Observe(time.Since(queryStart).Seconds())
+	if err != nil {
+		nearbyQueryErrors.Inc()
+		log.Println(err)
+		return nil, err
+	}
+
+	matches := 0
+	for _, result := range results {
+		dz := config.Floors.Elevation(event.Floor) - config.Floors.Elevation(result.Floor)
+		distance := geo.Distance3D(event.LonLat, result.LonLat, dz)
+		accA, accB := float64(event.Accuracy), float64(result.Accuracy)
+		matched, score := m.rule.Match(distance, accA, accB, config.ContactDistance)
+		if event.ID == result.ID || !matched {
+			continue
+		}
+		if event.Floor == result.Floor && config.Floors.Separated(event.Floor, event.LonLat, result.LonLat) {
+			nearbySeparated.Inc()
+			continue
+		}
+		matches++
+
+		events := [2]PartialPositionEvent{
+			{
+				ID:           event.ID,
+				DeviceID:     event.DeviceID,
+				Accuracy:     event.Accuracy,
+				LonLat:       event.LonLat,
+				Interpolated: event.Interpolated,
+			},
+			{
+				ID:           result.ID,
+				DeviceID:     result.DeviceID,
+				Accuracy:     result.Accuracy,
+				LonLat:       result.LonLat,
+				Interpolated: result.Interpolated,
+			},
+		}
+		if events[0].DeviceID > events[1].DeviceID {
+			events[0], events[1] = events[1], events[0]
+		}
+
+		minuteAggregate := MinuteAggregate{
+			TimeBucket:  event.TimeBucket,
+			BucketSize:  event.BucketSize,
+			Events:      events,
+			Distance:    distance,
+			Floor:       event.Floor,
+			Venue:       event.Venue,
+			Rule:        m.rule,
+			Score:       score,
+			Probability: ContactProbability(distance, accA, accB, config.ContactDistance),
+			Pending:     true,
+		}
+
+		id, insertErr := m.store.InsertMinuteAggregate(minuteAggregate)
+		if insertErr != nil {
+			// duplicate minute aggregates are ok, the other event of the pair created it
+			if insertErr == ErrDuplicate {
+				minuteAggregatesTotal.WithLabelValues(resultDuplicate).Inc()
+			} else {
+				minuteAggregatesTotal.WithLabelValues(resultError).Inc()
+				log.Println("error inserting minute aggregate", insertErr)
+				err = insertErr
 			}
+			continue
 		}
+		minuteAggregatesTotal.WithLabelValues(resultInserted).Inc()
 
+		minuteAggregate.ID = id
+		minuteAggregates = append(minuteAggregates, minuteAggregate)
 	}
+
+	nearbyMatches.Observe(float64(matches))
+	return minuteAggregates, err
 }
 
-func AggregateWorker(
-	db *mongo.Database,
-	minAggregatePartitionChannel chan MinuteAggregate,
-	wg *sync.WaitGroup,
-	workerNum int,
-) {
-	defer wg.Done()
+func (c EventWorkerConfig) publish(minuteAggregate MinuteAggregate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.PublishTimeout)
+	defer cancel()
+	return c.Broker.PublishMinuteAggregate(ctx, minuteAggregate)
+}
 
-	minuteAggregateCol := db.Collection("minute-aggregation")
-	contactEventCol := db.Collection("contact-event")
+// AggregateWorkerConfig defines configuration values for an AggregateWorker
+type AggregateWorkerConfig struct {
+	Store            Store
+	MinAggregateChan <-chan MinuteAggregate
+	WG               *sync.WaitGroup
+	// MaxGap is how long without contact there can be between two minute
+	// aggregates for them to be merged, rounded down to whole time buckets
+	MaxGap time.Duration
+	// CloseDelay is how long after the last minute aggregates that could
+	// extend a contact event would arrive on time it is considered closed,
+	// so that merging late minute aggregates into it records a ContactChange
+	CloseDelay time.Duration
+	Name       int
+}
 
-	for minAggregate := range minAggregatePartitionChannel {
-		devices := [2]string{minAggregate.Events[0].DeviceID, minAggregate.Events[1].DeviceID}
-		res, err := minuteAggregateCol.InsertOne(context.Background(), minAggregate)
+// AggregateWorker merges stored minute aggregates from a broker partition
+// into contact events and acknowledges them once merged
+func AggregateWorker(c AggregateWorkerConfig) {
+	defer c.WG.Done()
 
-		if err != nil {
-			if merr, ok := err.(mongo.WriteException); ok {
-				// single duplicate key error which we are ok with
-				if len(merr.WriteErrors) == 1 && merr.WriteErrors[0].Code == 11000 {
-					continue
-				}
-			}
+	for minAggregate := range c.MinAggregateChan {
+		mergeMinuteAggregate(c.Store, minAggregate, c.MaxGap, closedBefore(time.Now(), minAggregate.BucketSize, c.MaxGap, c.CloseDelay))
+	}
+}
 
-			log.Println("error inserting minute aggregate", err)
-			continue
-		}
+// closedBefore returns the time bucket of bucketSize before which contact
+// events are closed at now, as no minute aggregate arriving within
+// closeDelay of its time bucket could extend them any more
+func closedBefore(now time.Time, bucketSize int64, maxGap time.Duration, closeDelay time.Duration) uint32 {
+	bucket := uint32((now.UnixNano()/int64(time.Millisecond) - closeDelay.Milliseconds()) / bucketSizeOf(bucketSize))
+	gap := gapBuckets(maxGap, bucketSize)
+	if bucket < gap+1 {
+		return 0
+	}
+	return bucket - gap - 1
+}
 
-		if res.InsertedID != nil && res.InsertedID != "" {
-			aggID := res.InsertedID.(primitive.ObjectID)
-			// if only the minute aggregate was "inserted" do we continue with the 5 min association
-			// base contact event of 1 minute
-
-			// high level algorithm:
-			// 1. for a 1 min contact event at T
-			// 2. check if contact event ending at T-1 exists, if so then merge
-			// 3. check if contact event starting at T+1 exists, if so then merge
-			// 4. either insert the contact event at T, or the newly merged event, plus also delete the obsolete events
-			contact := ContactEvent{
-				Devices:          devices,
-				Start:            minAggregate.TimeBucket,
-				End:              minAggregate.TimeBucket,
-				MinuteAggregates: []primitive.ObjectID{aggID},
-				Duration:         1,
-				FirstContact: MinuteAggregate{
-					Events: [2]PartialPositionEvent{
-						{
-							DeviceID: minAggregate.Events[0].DeviceID,
-							LonLat:   minAggregate.Events[0].LonLat,
-							Accuracy: minAggregate.Events[0].Accuracy,
-						},
-						{
-							DeviceID: minAggregate.Events[1].DeviceID,
-							LonLat:   minAggregate.Events[1].LonLat,
-							Accuracy: minAggregate.Events[1].Accuracy,
-						},
-					},
-					Floor: minAggregate.Floor,
+// mergeMinuteAggregate merges minAggregate into the contact events of its
+// devices and acknowledges it once merged
+func mergeMinuteAggregate(store Store, minAggregate MinuteAggregate, maxGap time.Duration, closedBefore uint32) error {
+	devices := [2]string{minAggregate.Events[0].DeviceID, minAggregate.Events[1].DeviceID}
+
+	// high level algorithm:
+	// 1. for a contact event of one time bucket at T
+	// 2. find contact events ending at or after T-1-MaxGap and starting at or before T+1+MaxGap,
+	//    with MaxGap in time buckets of the same size
+	// 3. either insert the contact event at T, or the newly merged event, plus also delete the obsolete events
+	// 4. add the minute to the daily exposure of the devices
+	contact := ContactEvent{
+		Devices:          devices,
+		Start:            minAggregate.TimeBucket,
+		End:              minAggregate.TimeBucket,
+		BucketSize:       minAggregate.BucketSize,
+		MinuteAggregates: []primitive.ObjectID{minAggregate.ID},
+		Duration:         bucketMinutes(minAggregate.BucketSize),
+		FirstContact: MinuteAggregate{
+			Events: [2]PartialPositionEvent{
+				{
+					DeviceID: minAggregate.Events[0].DeviceID,
+					LonLat:   minAggregate.Events[0].LonLat,
+					Accuracy: minAggregate.Events[0].Accuracy,
 				},
-				MinDistance: minAggregate.Distance,
-				MaxDistance: minAggregate.Distance,
-			}
-			// TODO this can at least be optimized to fetch both T-1 and T+1 in one go
-			// Also can probably reuse one of the T-1 and T+1 for extension instead of having to delete
-			var operations []mongo.WriteModel
-
-			// find contact event of T-1 minute
-			var contactBefore ContactEvent
-			filter := bson.M{"devices": devices, "end": minAggregate.TimeBucket - 1}
-			err := contactEventCol.FindOne(context.Background(), filter, options.FindOne()).Decode(&contactBefore)
-			if err == nil {
-				contact.Start = contactBefore.Start
-				contact.MinuteAggregates = append(contactBefore.MinuteAggregates, contact.MinuteAggregates...)
-				contact.Duration = contact.Duration + contactBefore.Duration
-				contact.FirstContact = contactBefore.FirstContact
-				if contactBefore.MinDistance < contact.MinDistance {
-					contact.MinDistance = contactBefore.MinDistance
-				}
-				if contactBefore.MaxDistance > contact.MaxDistance {
-					contact.MaxDistance = contactBefore.MaxDistance
-				}
-
-				// delete T-1
-				operation := mongo.NewDeleteOneModel()
-				operation.SetFilter(bson.M{"devices": contactBefore.Devices, "start": contactBefore.Start, "end": contactBefore.End})
-				operations = append(operations, operation)
-			}
-			// find contact event of T+1 minute
-			var contactAfter ContactEvent
-			filter = bson.M{"devices": devices, "start": minAggregate.TimeBucket + 1}
-			err = contactEventCol.FindOne(context.Background(), filter, options.FindOne()).Decode(&contactAfter)
-			if err == nil {
-				contact.End = contactAfter.End
-				contact.MinuteAggregates = append(contact.MinuteAggregates, contactAfter.MinuteAggregates...)
-				contact.Duration = contact.Duration + contactAfter.Duration
-				if contactAfter.MinDistance < contact.MinDistance {
-					contact.MinDistance = contactAfter.MinDistance
-				}
-				if contactAfter.MaxDistance > contact.MaxDistance {
-					contact.MaxDistance = contactAfter.MaxDistance
-				}
-
-				// delete T+1
-				operation := mongo.NewDeleteOneModel()
-				operation.SetFilter(bson.M{"devices": contactAfter.Devices, "start": contactAfter.Start, "end": contactAfter.End})
-				operations = append(operations, operation)
+				{
+					DeviceID: minAggregate.Events[1].DeviceID,
+					LonLat:   minAggregate.Events[1].LonLat,
+					Accuracy: minAggregate.Events[1].Accuracy,
+				},
+			},
+			Floor: minAggregate.Floor,
+		},
+		MinDistance:     minAggregate.Distance,
+		MaxDistance:     minAggregate.Distance,
+		ExposureMinutes: minAggregate.Probability * bucketMinutes(minAggregate.BucketSize),
+		Venue:           minAggregate.Venue,
+	}
 
-			}
-			// insert the contact event at T
-			operation := mongo.NewInsertOneModel()
-			operation.SetDocument(contact)
-			operations = append(operations, operation)
-
-			_, err = contactEventCol.BulkWrite(context.Background(), operations, &options.BulkWriteOptions{})
-			if err != nil {
-				log.Println("error bulkwriting contact events", err)
-			}
-		}
+	_, err := store.MergeContact(contact, gapBuckets(maxGap, minAggregate.BucketSize), closedBefore)
+	if err != nil {
+		contactMergesTotal.WithLabelValues(resultError).Inc()
+		log.Println("error bulkwriting contact events", err)
+		return err
+	}
+	contactMergesTotal.WithLabelValues(resultMerged).Inc()
+
+	if err := store.AckMinuteAggregate(minAggregate.ID); err != nil {
+		log.Println("error acknowledging minute aggregate", err)
 	}
+	return nil
 }
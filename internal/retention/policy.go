@@ -0,0 +1,80 @@
+package retention
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// Policy is how long data is kept, by default and for specific venues
+type Policy struct {
+	Default time.Duration
+	Venues  map[string]time.Duration
+}
+
+// ParsePolicy builds a Policy from a default number of days and a comma
+// separated list of venue=days overrides, eg. "my-venue=14,other-venue=60"
+func ParsePolicy(defaultDays string, venueDays string) (policy Policy, err error) {
+	policy = Policy{
+		Default: 30 * day,
+		Venues:  map[string]time.Duration{},
+	}
+
+	if defaultDays != "" {
+		policy.Default, err = parseDays(defaultDays)
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	for _, pair := range strings.Split(venueDays, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return policy, fmt.Errorf("venue retention %q must look like venue=days", pair)
+		}
+
+		policy.Venues[parts[0]], err = parseDays(parts[1])
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	return policy, nil
+}
+
+func parseDays(days string) (time.Duration, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(days))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("retention of %q days must be a positive whole number", days)
+	}
+	return time.Duration(n) * day, nil
+}
+
+// For returns the retention period of venue
+func (p Policy) For(venue string) time.Duration {
+	if retention, ok := p.Venues[venue]; ok {
+		return retention
+	}
+	return p.Default
+}
+
+// Shortest returns the shortest retention period of the policy. It applies
+// to records that predate storing the venue on them, since they could
+// belong to any venue.
+func (p Policy) Shortest() time.Duration {
+	shortest := p.Default
+	for _, retention := range p.Venues {
+		if retention < shortest {
+			shortest = retention
+		}
+	}
+	return shortest
+}
@@ -0,0 +1,50 @@
+package retention
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePolicyDefaults(t *testing.T) {
+	policy, err := ParsePolicy("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy.Default != 30*day {
+		t.Errorf("expected default of 30 days but got %v", policy.Default)
+	}
+	if policy.For("any-venue") != 30*day {
+		t.Errorf("expected venue without override to use the default but got %v", policy.For("any-venue"))
+	}
+}
+
+func TestParsePolicyVenues(t *testing.T) {
+	policy, err := ParsePolicy("21", "short-venue=7, long-venue=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Duration{
+		"short-venue": 7 * day,
+		"long-venue":  60 * day,
+		"other-venue": 21 * day,
+	}
+	for venue, retention := range expected {
+		if policy.For(venue) != retention {
+			t.Errorf("expected %s to keep data for %v but got %v", venue, retention, policy.For(venue))
+		}
+	}
+
+	if policy.Shortest() != 7*day {
+		t.Errorf("expected shortest retention of 7 days but got %v", policy.Shortest())
+	}
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	for _, venueDays := range []string{"venue", "venue=", "venue=-1", "=5", "venue=1.5"} {
+		if _, err := ParsePolicy("", venueDays); err == nil {
+			t.Errorf("expected %q to be invalid", venueDays)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package retention
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const deleteBatchSize = 1000
+
+// defaultVenue labels records of venues without their own retention
+// period and legacyVenue records that were stored before the venue was
+const defaultVenue = "(default)"
+const legacyVenue = "(none)"
+
+var deletedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "contact_monitoring",
+	Name:      "retention_deleted_total",
+	Help:      "Records deleted by the retention purge by collection and venue.",
+}, []string{"collection", "venue"})
+
+var lastPurge = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "contact_monitoring",
+	Name:      "retention_last_purge_timestamp_seconds",
+	Help:      "Unix time of the last retention purge that completed without errors.",
+})
+
+// target is a collection to purge, the time bucket field that decides
+// when its records expire, the field holding the size of that time bucket
+// and the field holding their venue. Records without a size field have
+// time buckets of the default size.
+type target struct {
+	collection string
+	field      string
+	sizeField  string
+	venueField string
+}
+
+// targets are purged in order from the most derived data to the raw
+// position events it was derived from. A daily exposure lists every venue
+// of its day so it is purged by the shortest retention among them.
+var targets = []target{
+	{collection: "contact-change", field: "contact.end", sizeField: "contact.bucketSize", venueField: "venue"},
+	{collection: "daily-exposure", field: "start", venueField: "venues"},
+	{collection: "contact-event", field: "end", sizeField: "bucketSize", venueField: "venue"},
+	{collection: "contact-lock", field: "end", sizeField: "bucketSize", venueField: "venue"},
+	{collection: "zone-occupancy", field: "timeBucket", sizeField: "bucketSize", venueField: "venue"},
+	{collection: "minute-aggregation", field: "timeBucket", sizeField: "bucketSize", venueField: "venue"},
+	{collection: "position-event", field: "timeBucket", sizeField: "bucketSize", venueField: "venue"},
+}
+
+// Result is what a purge removed from one collection for one venue
+type Result struct {
+	Collection string    `bson:"collection" json:"collection"`
+	Venue      string    `bson:"venue" json:"venue"`
+	Cutoff     time.Time `bson:"cutoff" json:"cutoff"`
+	Deleted    int64     `bson:"deleted" json:"deleted"`
+}
+
+// Report is the record of a purge which is kept in the retention-log
+// collection as proof that data was deleted on schedule
+type Report struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Started  time.Time          `bson:"started" json:"started"`
+	Finished time.Time          `bson:"finished" json:"finished"`
+	Results  []Result           `bson:"results" json:"results"`
+	Error    string             `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// Purger deletes position events, minute aggregates and contact events
+// once they are older than the retention period of their venue
+type Purger struct {
+	DB     *mongo.Database
+	Policy Policy
+	// BucketSize is the default length of a time bucket in milliseconds,
+	// which records stored without a size have
+	BucketSize int64
+	// BucketSizes are the other lengths a time bucket can have
+	BucketSizes []int64
+}
+
+// Purge deletes every expired record in batches and stores a Report
+// of what was deleted in the retention-log collection
+func (p *Purger) Purge(ctx context.Context) (report Report, err error) {
+	report.Started = time.Now()
+
+	overrides := make([]string, 0, len(p.Policy.Venues))
+	for venue := range p.Policy.Venues {
+		overrides = append(overrides, venue)
+	}
+
+	for _, t := range targets {
+		for venue, retention := range p.Policy.Venues {
+			result, err := p.purge(ctx, t, venue, bson.M{t.venueField: venue}, report.Started.Add(-retention))
+			report.Results = append(report.Results, result)
+			if err != nil {
+				return p.finish(ctx, report, err)
+			}
+		}
+
+		result, err := p.purge(ctx, t, defaultVenue, bson.M{t.venueField: bson.M{"$exists": true, "$nin": overrides}}, report.Started.Add(-p.Policy.Default))
+		report.Results = append(report.Results, result)
+		if err != nil {
+			return p.finish(ctx, report, err)
+		}
+
+		result, err = p.purge(ctx, t, legacyVenue, bson.M{t.venueField: bson.M{"$exists": false}}, report.Started.Add(-p.Policy.Shortest()))
+		report.Results = append(report.Results, result)
+		if err != nil {
+			return p.finish(ctx, report, err)
+		}
+	}
+
+	lastPurge.SetToCurrentTime()
+	return p.finish(ctx, report, nil)
+}
+
+// purge deletes the records of t matching filter whose time bucket
+// is before cutoff, deleteBatchSize at a time
+func (p *Purger) purge(ctx context.Context, t target, venue string, filter bson.M, cutoff time.Time) (result Result, err error) {
+	result = Result{Collection: t.collection, Venue: venue, Cutoff: cutoff}
+
+	col := p.DB.Collection(t.collection)
+	filter["$or"] = p.cutoffFilters(t, cutoff)
+
+	for {
+		cursor, err := col.Find(
+			ctx,
+			filter,
+			options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(deleteBatchSize),
+		)
+		if err != nil {
+			return result, err
+		}
+
+		var batch []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &batch); err != nil {
+			return result, err
+		}
+		if len(batch) == 0 {
+			return result, nil
+		}
+
+		ids := make([]primitive.ObjectID, len(batch))
+		for i, doc := range batch {
+			ids[i] = doc.ID
+		}
+
+		res, err := col.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return result, err
+		}
+		result.Deleted += res.DeletedCount
+		deletedTotal.WithLabelValues(t.collection, result.Venue).Add(float64(res.DeletedCount))
+
+		if len(batch) < deleteBatchSize {
+			return result, nil
+		}
+	}
+}
+
+// cutoffFilters match the records of t whose time bucket is before
+// cutoff, with a filter for each time bucket size
+func (p *Purger) cutoffFilters(t target, cutoff time.Time) bson.A {
+	ms := cutoff.UnixNano() / int64(time.Millisecond)
+	if t.sizeField == "" {
+		return bson.A{bson.M{t.field: bson.M{"$lt": uint32(ms / p.BucketSize)}}}
+	}
+
+	filters := bson.A{bson.M{
+		t.sizeField: bson.M{"$exists": false},
+		t.field:     bson.M{"$lt": uint32(ms / p.BucketSize)},
+	}}
+	for _, size := range p.BucketSizes {
+		filters = append(filters, bson.M{
+			t.sizeField: size,
+			t.field:     bson.M{"$lt": uint32(ms / size)},
+		})
+	}
+	return filters
+}
+
+func (p *Purger) finish(ctx context.Context, report Report, err error) (Report, error) {
+	report.Finished = time.Now()
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	res, insertErr := p.DB.Collection("retention-log").InsertOne(ctx, report)
+	if insertErr != nil {
+		log.Println("error storing retention report", insertErr)
+	} else {
+		report.ID = res.InsertedID.(primitive.ObjectID)
+	}
+
+	return report, err
+}
+
+// Lease is the lease held by the one process that purges, so that with
+// several event worker replicas each purge runs once
+const Lease = "retention"
+
+// Leaser acquires a named lease for holder until ttl from now, or renews
+// it, and reports false when another holder has it
+type Leaser interface {
+	AcquireLease(name string, holder string, ttl time.Duration) (acquired bool, err error)
+}
+
+// Worker runs a purge right away and then every interval until stop is
+// closed. It only purges while holder holds Lease, which it renews for
+// leaseTTL on every interval, so leaseTTL has to be longer than interval.
+func Worker(
+	purger *Purger,
+	leaser Leaser,
+	holder string,
+	interval time.Duration,
+	leaseTTL time.Duration,
+	stop chan struct{},
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		leased, err := leaser.AcquireLease(Lease, holder, leaseTTL)
+		if err != nil {
+			log.Println("error acquiring the retention lease", err)
+		}
+		if leased {
+			purge(purger)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purge(purger *Purger) {
+	report, err := purger.Purge(context.Background())
+	if err != nil {
+		log.Println("error purging expired data", err)
+	}
+	for _, result := range report.Results {
+		if result.Deleted > 0 {
+			log.Printf("Purged %d %s records of venue %s older than %s\n", result.Deleted, result.Collection, result.Venue, result.Cutoff.Format(time.RFC3339))
+		}
+	}
+}
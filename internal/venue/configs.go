@@ -0,0 +1,120 @@
+package venue
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Configs resolves the configuration that applies to a venue
+type Configs interface {
+	For(venue string) Config
+}
+
+// withDefaults fills the zero values of config from defaults
+func withDefaults(config Config, defaults Config) Config {
+	if config.AccuracyThreshold == 0 {
+		config.AccuracyThreshold = defaults.AccuracyThreshold
+	}
+	if config.ContactDistance == 0 {
+		config.ContactDistance = defaults.ContactDistance
+	}
+	if config.MinContactDuration == 0 {
+		config.MinContactDuration = defaults.MinContactDuration
+	}
+	if config.TimeBucketSize == 0 {
+		config.TimeBucketSize = defaults.TimeBucketSize
+	}
+	if config.Floors == nil {
+		config.Floors = defaults.Floors
+	}
+	return config
+}
+
+type fixed struct {
+	config Config
+}
+
+// Fixed returns Configs which gives every venue the same configuration
+func Fixed(config Config) Configs {
+	return &fixed{config}
+}
+
+func (f *fixed) For(venue string) Config {
+	config := f.config
+	config.Venue = venue
+	return config
+}
+
+type cachedEntry struct {
+	config  Config
+	expires time.Time
+}
+
+// Cache is Configs backed by a Repo. Configurations are kept for a ttl
+// so the ingest pipeline doesn't read the repo for every event, which
+// means a change can take up to ttl to apply on other instances.
+type Cache struct {
+	repo     Repo
+	defaults Config
+	ttl      time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]cachedEntry
+}
+
+// NewCache returns a Cache over repo which fills unset values from defaults
+func NewCache(repo Repo, defaults Config, ttl time.Duration) *Cache {
+	return &Cache{
+		repo:     repo,
+		defaults: defaults,
+		ttl:      ttl,
+		entries:  map[string]cachedEntry{},
+	}
+}
+
+// For returns the configuration of venue. When the repo can't be read
+// the last known configuration is used, or the defaults if there is none.
+func (c *Cache) For(venue string) Config {
+	c.mu.RLock()
+	entry, ok := c.entries[venue]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.config
+	}
+
+	stored, err := c.repo.Get(venue)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println("error getting venue config", venue, err)
+		if ok {
+			return entry.config
+		}
+		return withDefaults(Config{Venue: venue}, c.defaults)
+	}
+
+	config := Config{Venue: venue}
+	if stored != nil {
+		config = *stored
+	}
+	config = withDefaults(config, c.defaults)
+
+	c.mu.Lock()
+	c.entries[venue] = cachedEntry{config: config, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return config
+}
+
+// Invalidate drops the cached configuration of venue
+func (c *Cache) Invalidate(venue string) {
+	c.mu.Lock()
+	delete(c.entries, venue)
+	c.mu.Unlock()
+}
+
+// Defaults returns the configuration used for values a venue doesn't set
+func (c *Cache) Defaults() Config {
+	return c.defaults
+}
@@ -0,0 +1,101 @@
+package venue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type fakeRepo struct {
+	configs map[string]Config
+	err     error
+	gets    int
+}
+
+func (r *fakeRepo) Get(venue string) (*Config, error) {
+	r.gets++
+	if r.err != nil {
+		return nil, r.err
+	}
+	config, ok := r.configs[venue]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &config, nil
+}
+
+func (r *fakeRepo) List() ([]Config, error) { return nil, nil }
+
+func (r *fakeRepo) Put(config Config) error {
+	r.configs[config.Venue] = config
+	return nil
+}
+
+func (r *fakeRepo) Delete(venue string) (bool, error) {
+	_, ok := r.configs[venue]
+	delete(r.configs, venue)
+	return ok, nil
+}
+
+var defaults = Config{
+	AccuracyThreshold:  10,
+	ContactDistance:    2,
+	MinContactDuration: 5,
+	TimeBucketSize:     60000,
+}
+
+func TestCacheFillsDefaults(t *testing.T) {
+	repo := &fakeRepo{configs: map[string]Config{
+		"atrium": {Venue: "atrium", AccuracyThreshold: 20},
+	}}
+	cache := NewCache(repo, defaults, time.Minute)
+
+	config := cache.For("atrium")
+	expected := Config{Venue: "atrium", AccuracyThreshold: 20, ContactDistance: 2, MinContactDuration: 5, TimeBucketSize: 60000}
+	if config != expected {
+		t.Errorf("expected %+v but got %+v", expected, config)
+	}
+
+	config = cache.For("office")
+	expected = defaults
+	expected.Venue = "office"
+	if config != expected {
+		t.Errorf("expected %+v but got %+v", expected, config)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	repo := &fakeRepo{configs: map[string]Config{}}
+	cache := NewCache(repo, defaults, time.Minute)
+
+	cache.For("office")
+	cache.For("office")
+	if repo.gets != 1 {
+		t.Errorf("expected the repo to be read once but was read %d times", repo.gets)
+	}
+
+	repo.Put(Config{Venue: "office", ContactDistance: 1})
+	cache.Invalidate("office")
+	if config := cache.For("office"); config.ContactDistance != 1 {
+		t.Errorf("expected contact distance 1 after invalidate but got %v", config.ContactDistance)
+	}
+}
+
+func TestCacheKeepsLastConfigOnError(t *testing.T) {
+	repo := &fakeRepo{configs: map[string]Config{
+		"atrium": {Venue: "atrium", AccuracyThreshold: 20},
+	}}
+	cache := NewCache(repo, defaults, 0)
+
+	cache.For("atrium")
+	repo.err = errors.New("connection refused")
+
+	if config := cache.For("atrium"); config.AccuracyThreshold != 20 {
+		t.Errorf("expected the last known accuracy threshold 20 but got %v", config.AccuracyThreshold)
+	}
+	if config := cache.For("office"); config.AccuracyThreshold != defaults.AccuracyThreshold {
+		t.Errorf("expected the default accuracy threshold but got %v", config.AccuracyThreshold)
+	}
+}
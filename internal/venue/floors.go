@@ -0,0 +1,119 @@
+package venue
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// FloorModel describes the floors of a venue so devices on different
+// floors can be matched: how high each floor is and which floors are open
+// to each other, eg. around an atrium or a mezzanine. Floor plans keep
+// devices on the same floor but on either side of a wall apart, and zones
+// name the areas of the floors whose occupancy is recorded.
+type FloorModel struct {
+	// Height is the height in meters of a storey, so that floor n is
+	// n times Height above floor 0 unless Elevations says otherwise
+	Height float64 `json:"height" bson:"height"`
+	// Elevations are the floors that aren't a whole number of storeys
+	// above floor 0, eg. a mezzanine or a split level
+	Elevations []FloorElevation `json:"elevations,omitempty" bson:"elevations,omitempty"`
+	// Open are groups of floors open to each other, so devices on any
+	// floor of a group can be in contact with devices on the others
+	Open [][]int16 `json:"open,omitempty" bson:"open,omitempty"`
+	// Plans are the walls and rooms of the floors that have them
+	Plans []FloorPlan `json:"plans,omitempty" bson:"plans,omitempty"`
+	// Zones are the named areas of the floors whose occupancy is recorded
+	Zones []Zone `json:"zones,omitempty" bson:"zones,omitempty"`
+}
+
+// FloorElevation is the height in meters of a floor above floor 0
+type FloorElevation struct {
+	Floor     int16   `json:"floor" bson:"floor"`
+	Elevation float64 `json:"elevation" bson:"elevation"`
+}
+
+// Elevation returns the height in meters of floor above floor 0, which
+// is always 0 without a floor model
+func (m *FloorModel) Elevation(floor int16) float64 {
+	if m == nil {
+		return 0
+	}
+	for _, e := range m.Elevations {
+		if e.Floor == floor {
+			return e.Elevation
+		}
+	}
+	return float64(floor) * m.Height
+}
+
+// ContactFloors returns floor and the floors open to it, sorted. Without
+// a floor model devices are only in contact on the same floor.
+func (m *FloorModel) ContactFloors(floor int16) []int16 {
+	floors := []int16{floor}
+	if m == nil {
+		return floors
+	}
+	for _, group := range m.Open {
+		if !containsFloor(group, floor) {
+			continue
+		}
+		for _, f := range group {
+			if !containsFloor(floors, f) {
+				floors = append(floors, f)
+			}
+		}
+	}
+
+	sort.Slice(floors, func(i, j int) bool {
+		return floors[i] < floors[j]
+	})
+	return floors
+}
+
+func (m *FloorModel) validate() error {
+	if m == nil {
+		return nil
+	}
+	if m.Height < 0 {
+		return errors.New("floors.height must not be negative")
+	}
+	for _, group := range m.Open {
+		if len(group) < 2 {
+			return errors.New("floors.open groups must have at least 2 floors")
+		}
+		// floors at the same elevation would be matched by their 2D
+		// distance as if they were one floor
+		for i, a := range group {
+			for _, b := range group[:i] {
+				if m.Elevation(a) == m.Elevation(b) {
+					return fmt.Errorf("floors.open floors %d and %d must be at different elevations; set floors.height or floors.elevations", b, a)
+				}
+			}
+		}
+	}
+	for i, plan := range m.Plans {
+		if m.plan(plan.Floor) != &m.Plans[i] {
+			return fmt.Errorf("floors.plans has more than one plan of floor %d", plan.Floor)
+		}
+		if err := plan.validate(); err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{}
+	for _, zone := range m.Zones {
+		if err := zone.validate(names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsFloor(floors []int16, floor int16) bool {
+	for _, f := range floors {
+		if f == floor {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package venue
+
+import (
+	"reflect"
+	"testing"
+)
+
+var atrium = &FloorModel{
+	Height:     4,
+	Elevations: []FloorElevation{{Floor: 1, Elevation: 2.5}},
+	Open:       [][]int16{{0, 1}, {2, 1}},
+}
+
+func TestFloorModelElevation(t *testing.T) {
+	tests := []struct {
+		model     *FloorModel
+		floor     int16
+		elevation float64
+	}{
+		{model: nil, floor: 3, elevation: 0},
+		{model: atrium, floor: 0, elevation: 0},
+		{model: atrium, floor: 1, elevation: 2.5},
+		{model: atrium, floor: 2, elevation: 8},
+		{model: atrium, floor: -1, elevation: -4},
+	}
+	for _, tt := range tests {
+		if elevation := tt.model.Elevation(tt.floor); elevation != tt.elevation {
+			t.Errorf("expected floor %d at %v but got %v", tt.floor, tt.elevation, elevation)
+		}
+	}
+}
+
+func TestFloorModelContactFloors(t *testing.T) {
+	tests := []struct {
+		model  *FloorModel
+		floor  int16
+		floors []int16
+	}{
+		{model: nil, floor: 1, floors: []int16{1}},
+		{model: atrium, floor: 0, floors: []int16{0, 1}},
+		{model: atrium, floor: 1, floors: []int16{0, 1, 2}},
+		{model: atrium, floor: 3, floors: []int16{3}},
+	}
+	for _, tt := range tests {
+		if floors := tt.model.ContactFloors(tt.floor); !reflect.DeepEqual(floors, tt.floors) {
+			t.Errorf("expected floor %d in contact with %v but got %v", tt.floor, tt.floors, floors)
+		}
+	}
+}
+
+func TestFloorModelValidateOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		model *FloorModel
+		valid bool
+	}{
+		{name: "atrium", model: atrium, valid: true},
+		{name: "elevations without height", model: &FloorModel{Elevations: []FloorElevation{{Floor: 1, Elevation: 3}}, Open: [][]int16{{0, 1}}}, valid: true},
+		{name: "single floor", model: &FloorModel{Height: 4, Open: [][]int16{{0}}}, valid: false},
+		{name: "no height", model: &FloorModel{Open: [][]int16{{0, 1}}}, valid: false},
+		{name: "same elevation", model: &FloorModel{Height: 4, Elevations: []FloorElevation{{Floor: 2, Elevation: 4}}, Open: [][]int16{{1, 2}}}, valid: false},
+		{name: "same floor twice", model: &FloorModel{Height: 4, Open: [][]int16{{1, 1}}}, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.model.validate(); (err == nil) != tt.valid {
+				t.Errorf("expected valid %v but got %v", tt.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package venue
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type putBody struct {
+	AccuracyThreshold  float64     `json:"accuracyThreshold"`
+	ContactDistance    float64     `json:"contactDistance"`
+	MinContactDuration int         `json:"minContactDuration"`
+	TimeBucketSize     int64       `json:"timeBucketSize"`
+	Floors             *FloorModel `json:"floors"`
+}
+
+func (b putBody) validate() error {
+	if b.AccuracyThreshold < 0 {
+		return errors.New("accuracyThreshold must not be negative")
+	}
+	if b.ContactDistance < 0 {
+		return errors.New("contactDistance must not be negative")
+	}
+	if b.MinContactDuration < 0 {
+		return errors.New("minContactDuration must not be negative")
+	}
+	if b.TimeBucketSize != 0 && !ValidTimeBucketSize(b.TimeBucketSize) {
+		return errors.New("timeBucketSize must be one of 15000, 30000, 60000 or 300000")
+	}
+	return b.Floors.validate()
+}
+
+// ListHandler returns a gin HandlerFunc which lists the
+// stored configuration of every venue
+func ListHandler(repo Repo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		configs, err := repo.List()
+		if err != nil {
+			log.Println("error listing venue configs", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to list venue configs"})
+			return
+		}
+
+		c.JSON(http.StatusOK, configs)
+	}
+}
+
+// GetHandler returns a gin HandlerFunc which returns the configuration
+// that applies to the venue param in route, including defaults
+func GetHandler(cache *Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, cache.For(c.Param("venue")))
+	}
+}
+
+// PutHandler returns a gin HandlerFunc which replaces the configuration
+// of the venue param in route. Omitted values fall back to the defaults.
+func PutHandler(repo Repo, cache *Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		venue := c.Param("venue")
+		var body putBody
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := body.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := repo.Put(Config{
+			Venue:              venue,
+			AccuracyThreshold:  body.AccuracyThreshold,
+			ContactDistance:    body.ContactDistance,
+			MinContactDuration: body.MinContactDuration,
+			TimeBucketSize:     body.TimeBucketSize,
+			Floors:             body.Floors,
+		})
+		if err != nil {
+			log.Println("error storing venue config", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to store venue config"})
+			return
+		}
+
+		cache.Invalidate(venue)
+		c.JSON(http.StatusOK, cache.For(venue))
+	}
+}
+
+// DeleteHandler returns a gin HandlerFunc which removes the configuration
+// of the venue param in route so the defaults apply to it again
+func DeleteHandler(repo Repo, cache *Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		venue := c.Param("venue")
+		deleted, err := repo.Delete(venue)
+		if err != nil {
+			log.Println("error deleting venue config", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to delete venue config"})
+			return
+		}
+		if !deleted {
+			c.JSON(http.StatusNotFound, gin.H{"error": "venue has no config"})
+			return
+		}
+
+		cache.Invalidate(venue)
+		c.Status(http.StatusOK)
+	}
+}
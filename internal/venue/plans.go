@@ -0,0 +1,156 @@
+package venue
+
+import (
+	"contact-monitoring-ingest-api/pkg/geo"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// FloorPlan is a GeoJSON FeatureCollection of the walls and rooms of a
+// floor. LineString and MultiLineString features are walls, Polygon
+// features are rooms.
+type FloorPlan struct {
+	Floor    int16         `json:"floor" bson:"floor"`
+	Type     string        `json:"type" bson:"type"`
+	Features []PlanFeature `json:"features" bson:"features"`
+}
+
+// PlanFeature is a GeoJSON Feature of a FloorPlan. Its properties are
+// kept so the plan reads back as uploaded, eg. with the names of rooms.
+type PlanFeature struct {
+	Type       string                 `json:"type" bson:"type"`
+	Properties map[string]interface{} `json:"properties" bson:"properties,omitempty"`
+	Geometry   PlanGeometry           `json:"geometry" bson:"geometry"`
+}
+
+// PlanGeometry is the GeoJSON geometry of a PlanFeature. Lines holds the
+// coordinates of every supported type as a list of lines: the one line of
+// a LineString, the lines of a MultiLineString or the rings of a Polygon.
+type PlanGeometry struct {
+	Type  string        `bson:"type"`
+	Lines [][]geo.Coord `bson:"lines"`
+}
+
+// GeoJSON geometry types of a FloorPlan
+const (
+	lineString      = "LineString"
+	multiLineString = "MultiLineString"
+	polygon         = "Polygon"
+)
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// UnmarshalJSON reads the coordinates of a GeoJSON geometry into Lines
+func (g *PlanGeometry) UnmarshalJSON(data []byte) error {
+	// null is left to validate, like a missing geometry
+	if string(data) == "null" {
+		return nil
+	}
+	var geometry geoJSONGeometry
+	if err := json.Unmarshal(data, &geometry); err != nil {
+		return err
+	}
+
+	g.Type = geometry.Type
+	switch geometry.Type {
+	case lineString:
+		var line []geo.Coord
+		if err := json.Unmarshal(geometry.Coordinates, &line); err != nil {
+			return err
+		}
+		g.Lines = [][]geo.Coord{line}
+	case multiLineString, polygon:
+		if err := json.Unmarshal(geometry.Coordinates, &g.Lines); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported geometry type %q; use %s, %s or %s", geometry.Type, lineString, multiLineString, polygon)
+	}
+	return nil
+}
+
+// MarshalJSON writes Lines back as the coordinates of a GeoJSON geometry
+func (g PlanGeometry) MarshalJSON() ([]byte, error) {
+	var coordinates interface{} = g.Lines
+	if g.Type == lineString && len(g.Lines) == 1 {
+		coordinates = g.Lines[0]
+	}
+	return json.Marshal(struct {
+		Type        string      `json:"type"`
+		Coordinates interface{} `json:"coordinates"`
+	}{g.Type, coordinates})
+}
+
+// plan returns the floor plan of floor, or nil when it has none
+func (m *FloorModel) plan(floor int16) *FloorPlan {
+	if m == nil {
+		return nil
+	}
+	for i := range m.Plans {
+		if m.Plans[i].Floor == floor {
+			return &m.Plans[i]
+		}
+	}
+	return nil
+}
+
+// Separated reports whether a and b on floor can't be in contact because
+// the line between them crosses a wall of the floor plan, or because they
+// are in different rooms of it. Being outside every room counts as being
+// in the same space. Floors without a plan separate nothing.
+func (m *FloorModel) Separated(floor int16, a geo.Coord, b geo.Coord) bool {
+	plan := m.plan(floor)
+	if plan == nil {
+		return false
+	}
+
+	for _, feature := range plan.Features {
+		if feature.Geometry.Type == polygon {
+			if geo.InPolygon(a, feature.Geometry.Lines) != geo.InPolygon(b, feature.Geometry.Lines) {
+				return true
+			}
+			continue
+		}
+		for _, line := range feature.Geometry.Lines {
+			for i := 1; i < len(line); i++ {
+				if geo.SegmentsIntersect(a, b, line[i-1], line[i]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (p FloorPlan) validate() error {
+	if p.Type != "FeatureCollection" {
+		return errors.New("floors.plans must be GeoJSON FeatureCollections")
+	}
+	for _, feature := range p.Features {
+		if feature.Type != "Feature" {
+			return errors.New("floors.plans features must be GeoJSON Features")
+		}
+		// a missing or null geometry leaves the type empty
+		switch feature.Geometry.Type {
+		case lineString, multiLineString, polygon:
+		default:
+			return fmt.Errorf("floors.plans features must have a %s, %s or %s geometry", lineString, multiLineString, polygon)
+		}
+		if len(feature.Geometry.Lines) == 0 {
+			return errors.New("floors.plans geometries must have coordinates")
+		}
+		for _, line := range feature.Geometry.Lines {
+			if feature.Geometry.Type == polygon && !closedRing(line) {
+				return errors.New("floors.plans polygon rings must be closed with at least 4 positions")
+			}
+			if len(line) < 2 {
+				return errors.New("floors.plans lines must have at least 2 positions")
+			}
+		}
+	}
+	return nil
+}
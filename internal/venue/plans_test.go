@@ -0,0 +1,90 @@
+package venue
+
+import (
+	"contact-monitoring-ingest-api/pkg/geo"
+	"encoding/json"
+	"testing"
+)
+
+// a floor with a wall along x = 10 up to y = 8 and a room over x = 20 to 30
+const planJSON = `{
+	"floor": 0,
+	"type": "FeatureCollection",
+	"features": [
+		{"type": "Feature", "properties": {}, "geometry": {"type": "LineString", "coordinates": [[10, 0], [10, 8]]}},
+		{"type": "Feature", "properties": {"name": "office"}, "geometry": {"type": "Polygon", "coordinates": [[[20, 0], [30, 0], [30, 10], [20, 10], [20, 0]]]}}
+	]
+}`
+
+func TestFloorModelSeparated(t *testing.T) {
+	var plan FloorPlan
+	if err := json.Unmarshal([]byte(planJSON), &plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.validate(); err != nil {
+		t.Fatal(err)
+	}
+	model := &FloorModel{Plans: []FloorPlan{plan}}
+
+	tests := []struct {
+		name      string
+		floor     int16
+		a, b      geo.Coord
+		separated bool
+	}{
+		{name: "same side of the wall", a: geo.Coord{5, 4}, b: geo.Coord{8, 4}, separated: false},
+		{name: "across the wall", a: geo.Coord{9, 4}, b: geo.Coord{11, 4}, separated: true},
+		{name: "around the end of the wall", a: geo.Coord{9, 9}, b: geo.Coord{11, 9}, separated: false},
+		{name: "in the room", a: geo.Coord{21, 4}, b: geo.Coord{25, 4}, separated: false},
+		{name: "in and out of the room", a: geo.Coord{19, 4}, b: geo.Coord{21, 4}, separated: true},
+		{name: "floor without a plan", floor: 1, a: geo.Coord{9, 4}, b: geo.Coord{11, 4}, separated: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if separated := model.Separated(tt.floor, tt.a, tt.b); separated != tt.separated {
+				t.Errorf("expected separated %v but got %v", tt.separated, separated)
+			}
+		})
+	}
+}
+
+func TestPlanGeometryRoundTrip(t *testing.T) {
+	for _, geometry := range []string{
+		`{"type":"LineString","coordinates":[[10,0],[10,8]]}`,
+		`{"type":"MultiLineString","coordinates":[[[0,0],[1,0]],[[0,1],[1,1]]]}`,
+		`{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}`,
+	} {
+		var g PlanGeometry
+		if err := json.Unmarshal([]byte(geometry), &g); err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != geometry {
+			t.Errorf("expected %s but got %s", geometry, data)
+		}
+	}
+
+	var g PlanGeometry
+	if err := json.Unmarshal([]byte(`{"type":"Point","coordinates":[0,0]}`), &g); err == nil {
+		t.Error("expected an error for an unsupported geometry type")
+	}
+}
+
+func TestFloorPlanRejectsFeaturesWithoutGeometry(t *testing.T) {
+	for _, feature := range []string{
+		`{"type": "Feature", "properties": {}}`,
+		`{"type": "Feature", "properties": {}, "geometry": null}`,
+		`{"type": "Feature", "properties": {}, "geometry": {"type": "MultiLineString", "coordinates": []}}`,
+	} {
+		var plan FloorPlan
+		if err := json.Unmarshal([]byte(`{"floor": 0, "type": "FeatureCollection", "features": [`+feature+`]}`), &plan); err != nil {
+			t.Fatal(err)
+		}
+		if err := plan.validate(); err == nil {
+			t.Errorf("expected an error for %s", feature)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package venue
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Config holds the processing settings of a venue. Zero values mean the
+// deployment wide default applies.
+type Config struct {
+	Venue string `json:"venue" bson:"_id"`
+	// AccuracyThreshold is the maximum accuracy in meters of position
+	// events that are processed
+	AccuracyThreshold float64 `json:"accuracyThreshold,omitempty" bson:"accuracyThreshold,omitempty"`
+	// ContactDistance is the maximum distance in meters between
+	// devices for them to be in contact
+	ContactDistance float64 `json:"contactDistance,omitempty" bson:"contactDistance,omitempty"`
+	// MinContactDuration is the minimum length in minutes of a contact
+	// event for it to be reported by default
+	MinContactDuration int `json:"minContactDuration,omitempty" bson:"minContactDuration,omitempty"`
+	// TimeBucketSize is the length of a time bucket in milliseconds,
+	// one of TimeBucketSizes
+	TimeBucketSize int64 `json:"timeBucketSize,omitempty" bson:"timeBucketSize,omitempty"`
+	// Floors, when set, lets devices on floors open to each other be in
+	// contact, measuring the distance between them in 3D, keeps devices
+	// apart across the walls of its floor plans and defines zones
+	Floors *FloorModel `json:"floors,omitempty" bson:"floors,omitempty"`
+}
+
+// TimeBucketSizes are the lengths of a time bucket in milliseconds
+// the pipeline can process
+var TimeBucketSizes = []int64{15 * 1000, 30 * 1000, 60 * 1000, 5 * 60 * 1000}
+
+// ValidTimeBucketSize reports whether size is one of TimeBucketSizes
+func ValidTimeBucketSize(size int64) bool {
+	for _, s := range TimeBucketSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Repo is an interface for accessing venue configuration
+// from its persistence layer
+type Repo interface {
+	Get(venue string) (config *Config, err error)
+	List() (configs []Config, err error)
+	Put(config Config) (err error)
+	Delete(venue string) (deleted bool, err error)
+}
+
+type repo struct {
+	col *mongo.Collection
+}
+
+// NewRepo returns a new Repo interface
+func NewRepo(col *mongo.Collection) Repo {
+	return &repo{
+		col,
+	}
+}
+
+// Get returns the configuration of venue
+func (r *repo) Get(venue string) (config *Config, err error) {
+	err = r.col.FindOne(
+		context.Background(),
+		bson.M{"_id": venue},
+	).Decode(&config)
+	return
+}
+
+// List returns the configuration of every venue that has one
+func (r *repo) List() (configs []Config, err error) {
+	cursor, err := r.col.Find(
+		context.Background(),
+		bson.M{},
+		options.Find().SetSort(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return
+	}
+
+	configs = []Config{}
+	err = cursor.All(context.Background(), &configs)
+	return
+}
+
+// Put creates or replaces the configuration of config.Venue
+func (r *repo) Put(config Config) (err error) {
+	_, err = r.col.ReplaceOne(
+		context.Background(),
+		bson.M{"_id": config.Venue},
+		config,
+		options.Replace().SetUpsert(true),
+	)
+	return
+}
+
+// Delete removes the configuration of venue so it uses the defaults again
+func (r *repo) Delete(venue string) (deleted bool, err error) {
+	result, err := r.col.DeleteOne(
+		context.Background(),
+		bson.M{"_id": venue},
+	)
+	if err != nil {
+		return
+	}
+	deleted = result.DeletedCount > 0
+	return
+}
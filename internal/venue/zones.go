@@ -0,0 +1,67 @@
+package venue
+
+import (
+	"contact-monitoring-ingest-api/pkg/geo"
+	"errors"
+	"fmt"
+)
+
+// Zone is a named area of a floor, eg. a room, whose occupancy is
+// recorded from the positions of the devices in it
+type Zone struct {
+	Name  string `json:"name" bson:"name"`
+	Floor int16  `json:"floor" bson:"floor"`
+	// Polygon holds the coordinates of a GeoJSON Polygon: the outer
+	// boundary of the zone followed by any holes
+	Polygon [][]geo.Coord `json:"polygon" bson:"polygon"`
+	// Capacity is how many devices the zone is meant to hold at once;
+	// occupancy is never over capacity when zero
+	Capacity int `json:"capacity,omitempty" bson:"capacity,omitempty"`
+}
+
+// ZoneAt returns the first zone of floor that contains lonlat, or nil
+// when it is in none
+func (m *FloorModel) ZoneAt(floor int16, lonlat geo.Coord) *Zone {
+	if m == nil {
+		return nil
+	}
+	for i, zone := range m.Zones {
+		if zone.Floor == floor && geo.InPolygon(lonlat, zone.Polygon) {
+			return &m.Zones[i]
+		}
+	}
+	return nil
+}
+
+// HasZones reports whether the venue defines any zones
+func (m *FloorModel) HasZones() bool {
+	return m != nil && len(m.Zones) > 0
+}
+
+func (z Zone) validate(names map[string]bool) error {
+	if z.Name == "" {
+		return errors.New("floors.zones must have a name")
+	}
+	if names[z.Name] {
+		return fmt.Errorf("floors.zones has more than one zone named %q", z.Name)
+	}
+	names[z.Name] = true
+
+	if len(z.Polygon) == 0 {
+		return fmt.Errorf("floors.zones %q must have a polygon", z.Name)
+	}
+	for _, ring := range z.Polygon {
+		if !closedRing(ring) {
+			return fmt.Errorf("floors.zones %q polygon rings must be closed with at least 4 positions", z.Name)
+		}
+	}
+	if z.Capacity < 0 {
+		return fmt.Errorf("floors.zones %q capacity must not be negative", z.Name)
+	}
+	return nil
+}
+
+// closedRing reports whether ring is a valid GeoJSON linear ring
+func closedRing(ring []geo.Coord) bool {
+	return len(ring) >= 4 && ring[0] == ring[len(ring)-1]
+}
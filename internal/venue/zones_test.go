@@ -0,0 +1,58 @@
+package venue
+
+import (
+	"contact-monitoring-ingest-api/pkg/geo"
+	"testing"
+)
+
+var meetingRoom = Zone{
+	Name:     "meeting-room",
+	Floor:    1,
+	Polygon:  [][]geo.Coord{{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}},
+	Capacity: 8,
+}
+
+func TestFloorModelZoneAt(t *testing.T) {
+	model := &FloorModel{Zones: []Zone{meetingRoom}}
+
+	if zone := model.ZoneAt(1, geo.Coord{5, 5}); zone == nil || zone.Name != meetingRoom.Name {
+		t.Errorf("expected %s but got %+v", meetingRoom.Name, zone)
+	}
+	if zone := model.ZoneAt(0, geo.Coord{5, 5}); zone != nil {
+		t.Errorf("expected no zone on another floor but got %+v", zone)
+	}
+	if zone := model.ZoneAt(1, geo.Coord{15, 5}); zone != nil {
+		t.Errorf("expected no zone outside the polygon but got %+v", zone)
+	}
+
+	var none *FloorModel
+	if zone := none.ZoneAt(1, geo.Coord{5, 5}); zone != nil || none.HasZones() {
+		t.Errorf("expected no zones without a floor model but got %+v", zone)
+	}
+}
+
+func TestFloorModelValidateZones(t *testing.T) {
+	open := meetingRoom
+	open.Name = "open"
+	open.Polygon = [][]geo.Coord{{{0, 0}, {10, 0}, {10, 10}, {0, 10}}}
+
+	tests := []struct {
+		name  string
+		zones []Zone
+		valid bool
+	}{
+		{name: "valid", zones: []Zone{meetingRoom}, valid: true},
+		{name: "duplicate names", zones: []Zone{meetingRoom, meetingRoom}, valid: false},
+		{name: "unnamed", zones: []Zone{{Polygon: meetingRoom.Polygon}}, valid: false},
+		{name: "open ring", zones: []Zone{open}, valid: false},
+		{name: "negative capacity", zones: []Zone{{Name: "hall", Polygon: meetingRoom.Polygon, Capacity: -1}}, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&FloorModel{Zones: tt.zones}).validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid %v but got %v", tt.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package geo
+
+import "math"
+
+// AccuracyConfidence is the probability that a device is within its
+// reported accuracy of its reported position, as defined by Android
+// and iOS location services
+const AccuracyConfidence = 0.68
+
+// accuracySigmas is how many standard deviations of a circular 2D
+// Gaussian contain AccuracyConfidence of its probability
+var accuracySigmas = math.Sqrt(-2 * math.Log(1-AccuracyConfidence))
+
+// AccuracySigma returns the standard deviation in meters along each axis
+// of the circular 2D Gaussian described by an accuracy in meters
+func AccuracySigma(accuracy float64) float64 {
+	return accuracy / accuracySigmas
+}
+
+// ProbabilityWithin returns the probability that two positions are within
+// radius meters of each other when they are distributed as circular 2D
+// Gaussians whose means are distance meters apart and whose standard
+// deviations are sigma1 and sigma2.
+//
+// The distance between the positions follows a Rice distribution, whose
+// CDF is computed here as a Poisson weighted sum of Gamma CDFs.
+func ProbabilityWithin(distance float64, sigma1 float64, sigma2 float64, radius float64) float64 {
+	if radius <= 0 {
+		return 0
+	}
+
+	variance := sigma1*sigma1 + sigma2*sigma2
+	if variance == 0 {
+		if distance <= radius {
+			return 1
+		}
+		return 0
+	}
+
+	// mean of the Poisson weights and upper limit of the Gamma CDFs
+	a := distance * distance / (2 * variance)
+	x := radius * radius / (2 * variance)
+
+	// terms beyond this many standard deviations past the Poisson mean
+	// are too small to matter
+	maxTerms := int(a+40*math.Sqrt(a)) + 100
+
+	probability := 0.0
+	gammaTail := 0.0 // e^-x * sum of x^j/j! for j <= k
+	for k := 0; k < maxTerms; k++ {
+		gammaTail += math.Exp(-x + float64(k)*math.Log(x) - lgamma(k+1))
+		gammaCDF := 1 - gammaTail
+		if gammaCDF <= 0 {
+			break
+		}
+
+		if a == 0 && k > 0 {
+			break
+		}
+		weight := math.Exp(-a)
+		if k > 0 {
+			weight = math.Exp(-a + float64(k)*math.Log(a) - lgamma(k+1))
+		}
+		probability += weight * gammaCDF
+
+		// past the Poisson mean the remaining terms only get smaller
+		if float64(k) > a && weight*gammaCDF < 1e-15 {
+			break
+		}
+	}
+
+	return math.Max(0, math.Min(1, probability))
+}
+
+func lgamma(n int) float64 {
+	v, _ := math.Lgamma(float64(n))
+	return v
+}
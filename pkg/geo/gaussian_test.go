@@ -0,0 +1,36 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var probabilityWithinTests = []struct {
+	distance, sigma1, sigma2, radius float64
+	out                              float64
+}{
+	// positions with the same mean are within radius with 1 - e^(-r²/2σ²)
+	{distance: 0, sigma1: 1, sigma2: 0, radius: 1, out: 1 - math.Exp(-0.5)},
+	{distance: 0, sigma1: AccuracySigma(5), sigma2: 0, radius: 5, out: AccuracyConfidence},
+	// reference values of the Rice CDF from numerical integration
+	{distance: 1, sigma1: 1, sigma2: 0, radius: 1, out: 0.26712019620359856},
+	{distance: 3, sigma1: math.Sqrt(0.5), sigma2: math.Sqrt(0.5), radius: 2, out: 0.11327924559661183},
+	{distance: 10, sigma1: 2, sigma2: 0, radius: 5, out: 0.00413674916836363},
+	{distance: 500, sigma1: 1, sigma2: 1, radius: 2, out: 0},
+	// exact positions
+	{distance: 1, sigma1: 0, sigma2: 0, radius: 2, out: 1},
+	{distance: 3, sigma1: 0, sigma2: 0, radius: 2, out: 0},
+}
+
+func TestProbabilityWithin(t *testing.T) {
+	for _, tt := range probabilityWithinTests {
+		t.Run(fmt.Sprintf("d=%v σ=%v,%v r=%v", tt.distance, tt.sigma1, tt.sigma2, tt.radius), func(t *testing.T) {
+			p := ProbabilityWithin(tt.distance, tt.sigma1, tt.sigma2, tt.radius)
+
+			if math.Abs(p-tt.out) > 1e-6 {
+				t.Errorf(`expected %v but got: %v`, tt.out, p)
+			}
+		})
+	}
+}
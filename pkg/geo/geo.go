@@ -40,3 +40,92 @@ func Distance(latlon1 Coord, latlon2 Coord) float64 {
 
 	return 2 * r * math.Asin(math.Sqrt(h))
 }
+
+// Distance3D returns the distance in meters between two points whose
+// heights differ by dz meters, treating the ground between them as flat
+// as it is over the distances between devices
+func Distance3D(latlon1 Coord, latlon2 Coord, dz float64) float64 {
+	return math.Hypot(Distance(latlon1, latlon2), dz)
+}
+
+// CircleIntersectionArea returns the area in square meters shared by two
+// circles with radii r1 and r2 in meters whose centres are d meters apart
+func CircleIntersectionArea(d float64, r1 float64, r2 float64) float64 {
+	if d >= r1+r2 {
+		return 0
+	}
+
+	// one circle lies entirely within the other
+	if d <= math.Abs(r1-r2) {
+		r := math.Min(r1, r2)
+		return math.Pi * r * r
+	}
+
+	a1 := r1 * r1 * math.Acos((d*d+r1*r1-r2*r2)/(2*d*r1))
+	a2 := r2 * r2 * math.Acos((d*d+r2*r2-r1*r1)/(2*d*r2))
+	kite := 0.5 * math.Sqrt((-d+r1+r2)*(d+r1-r2)*(d-r1+r2)*(d+r1+r2))
+	return a1 + a2 - kite
+}
+
+// SegmentsIntersect reports whether the segment from a1 to a2 crosses or
+// touches the segment from b1 to b2. Coordinates are treated as planar,
+// which is accurate enough at the scale of a building.
+func SegmentsIntersect(a1 Coord, a2 Coord, b1 Coord, b2 Coord) bool {
+	d1 := orientation(b1, b2, a1)
+	d2 := orientation(b1, b2, a2)
+	d3 := orientation(a1, a2, b1)
+	d4 := orientation(a1, a2, b2)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+
+	// collinear end points touching the other segment
+	return (d1 == 0 && onSegment(b1, b2, a1)) ||
+		(d2 == 0 && onSegment(b1, b2, a2)) ||
+		(d3 == 0 && onSegment(a1, a2, b1)) ||
+		(d4 == 0 && onSegment(a1, a2, b2))
+}
+
+// orientation returns the cross product of p-a and b-a, which is positive
+// when p is to the left of the line from a to b, negative when it is to
+// the right and zero when the three are collinear
+func orientation(a Coord, b Coord, p Coord) float64 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
+
+// onSegment reports whether p, collinear with a and b, lies between them
+func onSegment(a Coord, b Coord, p Coord) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
+// InPolygon reports whether point lies inside polygon, given as GeoJSON
+// polygon rings: the outer boundary followed by any holes. Coordinates are
+// treated as planar like in SegmentsIntersect.
+func InPolygon(point Coord, polygon [][]Coord) bool {
+	if len(polygon) == 0 || !inRing(point, polygon[0]) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if inRing(point, hole) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRing casts a ray from point along increasing longitude and counts the
+// edges of ring it crosses, which is odd when point is inside
+func inRing(point Coord, ring []Coord) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > point[1]) != (b[1] > point[1]) &&
+			point[0] < a[0]+(point[1]-a[1])*(b[0]-a[0])/(b[1]-a[1]) {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -2,6 +2,7 @@ package geo
 
 import (
 	"fmt"
+	"math"
 	"testing"
 )
 
@@ -38,3 +39,87 @@ func TestDistance(t *testing.T) {
 		})
 	}
 }
+
+var circleIntersectionTests = []struct {
+	d, r1, r2 float64
+	out       float64
+}{
+	{d: 0, r1: 1, r2: 1, out: math.Pi},
+	{d: 2, r1: 1, r2: 1, out: 0},
+	{d: 5, r1: 1, r2: 1, out: 0},
+	{d: 0.5, r1: 3, r2: 1, out: math.Pi},
+	{d: 1, r1: 1, r2: 1, out: 2*math.Pi/3 - math.Sqrt(3)/2},
+}
+
+func TestCircleIntersectionArea(t *testing.T) {
+	for _, tt := range circleIntersectionTests {
+		t.Run(fmt.Sprintf("d=%v r1=%v r2=%v", tt.d, tt.r1, tt.r2), func(t *testing.T) {
+			area := CircleIntersectionArea(tt.d, tt.r1, tt.r2)
+
+			if math.Abs(area-tt.out) > 1e-9 {
+				t.Errorf(`expected %v but got: %v`, tt.out, area)
+			}
+		})
+	}
+}
+
+func TestDistance3D(t *testing.T) {
+	a, b := Coord{43.481940, -80.537687}, Coord{43.481979, -80.537590}
+
+	if dist := Distance3D(a, b, 0); dist != Distance(a, b) {
+		t.Errorf(`expected %v but got: %v`, Distance(a, b), dist)
+	}
+	if dist := Distance3D(a, a, -3); dist != 3 {
+		t.Errorf(`expected 3 but got: %v`, dist)
+	}
+}
+
+var segmentsIntersectTests = []struct {
+	name string
+	in   [4]Coord
+	out  bool
+}{
+	{name: "crossing", in: [4]Coord{{0, 0}, {2, 2}, {0, 2}, {2, 0}}, out: true},
+	{name: "parallel", in: [4]Coord{{0, 0}, {2, 0}, {0, 1}, {2, 1}}, out: false},
+	{name: "short of the other", in: [4]Coord{{0, 0}, {1, 1}, {0, 3}, {3, 0}}, out: false},
+	{name: "touching at an end", in: [4]Coord{{0, 0}, {1, 1}, {1, 1}, {2, 0}}, out: true},
+	{name: "collinear overlapping", in: [4]Coord{{0, 0}, {2, 0}, {1, 0}, {3, 0}}, out: true},
+	{name: "collinear apart", in: [4]Coord{{0, 0}, {1, 0}, {2, 0}, {3, 0}}, out: false},
+}
+
+func TestSegmentsIntersect(t *testing.T) {
+	for _, tt := range segmentsIntersectTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if intersect := SegmentsIntersect(tt.in[0], tt.in[1], tt.in[2], tt.in[3]); intersect != tt.out {
+				t.Errorf(`expected %v but got: %v`, tt.out, intersect)
+			}
+		})
+	}
+}
+
+// a 4x4 square with a 2x2 hole in the middle
+var square = [][]Coord{
+	{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}},
+	{{1, 1}, {3, 1}, {3, 3}, {1, 3}, {1, 1}},
+}
+
+var inPolygonTests = []struct {
+	in  Coord
+	out bool
+}{
+	{in: Coord{0.5, 0.5}, out: true},
+	{in: Coord{3.5, 2}, out: true},
+	{in: Coord{2, 2}, out: false},
+	{in: Coord{5, 2}, out: false},
+	{in: Coord{-1, -1}, out: false},
+}
+
+func TestInPolygon(t *testing.T) {
+	for _, tt := range inPolygonTests {
+		t.Run(fmt.Sprintf("%v", tt.in), func(t *testing.T) {
+			if inside := InPolygon(tt.in, square); inside != tt.out {
+				t.Errorf(`expected %v but got: %v`, tt.out, inside)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 /**
  * ensure that the mongodb instance has these indexes
  * for adequate performance
+ *
+ * the service creates these itself on startup, see
+ * internal/indexes, keep the two in sync
  */
 
 db.getCollection('contact-event').createIndex({
@@ -9,6 +12,11 @@ db.getCollection('contact-event').createIndex({
     "start" : -1
 });
 
+db.getCollection('contact-event').createIndex({
+    "devices" : 1,
+    "startTime" : 1
+});
+
 db.getCollection('contact-event').createIndex({
     "devices.0" : 1,
     "devices.1" : 1,
@@ -31,6 +39,63 @@ db.getCollection('contact-event').createIndex({
     "mindistance" : 1
 });
 
+db.getCollection('contact-event').createIndex({
+    "venue" : 1,
+    "end" : 1
+});
+
+db.getCollection('contact-event').createIndex({
+    "minuteaggregates" : 1
+});
+
+db.getCollection('contact-change').createIndex({
+    "seq" : 1
+});
+
+db.getCollection('contact-change').createIndex({
+    "venue" : 1,
+    "seq" : 1
+});
+
+db.getCollection('contact-change').createIndex({
+    "contact.end" : 1
+});
+
+db.getCollection('contact-lock').createIndex({
+    "devices.0" : 1,
+    "devices.1" : 1
+}, {
+    "unique" : true
+});
+
+db.getCollection('contact-lock').createIndex({
+    "end" : 1
+});
+
+// the _id index every collection has, so that the counter collection
+// transactions increment is created before them
+db.getCollection('counter').createIndex({
+    "_id" : 1
+});
+
+db.getCollection('daily-exposure').createIndex({
+    "devices.0" : 1,
+    "devices.1" : 1,
+    "day" : 1
+}, {
+    "unique" : true
+});
+
+db.getCollection('daily-exposure').createIndex({
+    "devices" : 1,
+    "day" : 1
+});
+
+db.getCollection('daily-exposure').createIndex({
+    "venues" : 1,
+    "start" : 1
+});
+
 db.getCollection('device').createIndex({
     "venue" : 1
 });
@@ -66,6 +131,11 @@ db.getCollection('minute-aggregation').createIndex({
     "timeBucket" : 1
 });
 
+db.getCollection('minute-aggregation').createIndex({
+    "venue" : 1,
+    "timeBucket" : 1
+});
+
 db.getCollection('position-event').createIndex({
     "device" : 1,
     "timeBucket" : 1
@@ -88,4 +158,24 @@ db.getCollection('position-event').createIndex({
 
 db.getCollection('position-event').createIndex({
     "venue" : 1
-});
\ No newline at end of file
+});
+db.getCollection('position-event').createIndex({
+    "pending" : 1
+}, {
+    "partialFilterExpression" : { "pending" : true }
+});
+
+db.getCollection('minute-aggregation').createIndex({
+    "pending" : 1
+}, {
+    "partialFilterExpression" : { "pending" : true }
+});
+
+db.getCollection('zone-occupancy').createIndex({
+    "venue" : 1,
+    "bucketSize" : 1,
+    "timeBucket" : 1,
+    "zone" : 1
+}, {
+    "unique": true
+});
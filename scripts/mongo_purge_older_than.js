@@ -1,12 +1,15 @@
 /**
  * use this to purge data older than the purgeDate
+ *
+ * the service purges data on a schedule itself using
+ * RETENTION_DAYS and VENUE_RETENTION_DAYS, see internal/retention
  */
 
 var purgeDate = Date.now() - 1000 * 60 * 60 * 24 * 30; // 30 days ago
 var bucketSize = 60 * 1000;
 var bucket = Math.floor(purgeDate / bucketSize);
 
-db.getCollection('position-events').deleteMany({
+db.getCollection('position-event').deleteMany({
     timeBucket: {
         $lt: bucket
     }
@@ -22,4 +25,15 @@ db.getCollection('contact-event').deleteMany({
     end: {
         $lt: bucket
     }
-});
\ No newline at end of file
+});
+
+db.getCollection('contact-lock').deleteMany({
+    end: {
+        $lt: bucket
+    }
+});
+db.getCollection('zone-occupancy').deleteMany({
+    timeBucket: {
+        $lt: bucket
+    }
+});